@@ -1,82 +1,310 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"io/ioutil"
 	"kad/node"
-
-	"github.com/kataras/golog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
-//NodeID the id of this node
-var NodeID node.NodeID
+//Config configuration of a node, the sources override each other in the
+//order: defaults, config file, environment variables, command-line flags
+type Config struct {
+	//Port server port
+	Port int `json:"port"`
+	//Listen the address to listen on, all interfaces at Port if empty
+	Listen string `json:"listen"`
+	//Advertise the address other nodes dial, the listen host at Port if
+	//empty, a missing host is filled by the nodes receiving the pings
+	Advertise string `json:"advertise"`
+	//Seeds addresses of the nodes to bootstrap from
+	Seeds []string `json:"seeds"`
+	//Network transport of rpcs, "tcp" or "udp", udp needs Plaintext
+	Network string `json:"network"`
+	//Plaintext turn off tls, the rpcs are neither encrypted nor
+	//authenticated by the transport
+	Plaintext bool `json:"plaintext"`
+	//IDBits width of nodeids in bits
+	IDBits int `json:"idbits"`
+	//IdentityFile the file keeping the private key of the node
+	IdentityFile string `json:"identity"`
+	//DataDir the directory of the data of the node, like the kbucket snapshot
+	DataDir string `json:"datadir"`
+	//SubnetBucket how many contacts of a /24 or /48 a bucket keeps, 0 for
+	//no limit
+	SubnetBucket int `json:"subnetbucket"`
+	//SubnetTable how many contacts of a /24 or /48 the kbucket keeps, 0 for
+	//no limit
+	SubnetTable int `json:"subnettable"`
+	//DisjointPaths how many disjoint paths a lookup takes, 1 for a plain
+	//lookup
+	DisjointPaths int `json:"disjointpaths"`
+	//Difficulty the leading zero bits of H(H(public key)) a nodeid needs,
+	//the static puzzle of S/Kademlia, 0 for none
+	Difficulty int `json:"difficulty"`
+}
 
-//Peers peers that configured
-var Seeds []string
+const (
+	//EnvPrefix prefix of the environment variables, like KAD_PORT
+	EnvPrefix = "KAD_"
+	//DefaultFile the config file read when none is given, it may be missing
+	DefaultFile = "./config.json"
+)
 
-//Port server port
-var Port int
+//Default the configuration used for everything no source sets
+func Default() *Config {
+	return &Config{
+		Port:          15200,
+		Seeds:         []string{},
+		Network:       "tcp",
+		IDBits:        160,
+		IdentityFile:  "./node.json",
+		DataDir:       ".",
+		SubnetBucket:  2,
+		SubnetTable:   3,
+		DisjointPaths: 1,
+	}
+}
 
-func init() {
-	err := readConfig()
-	if err != nil {
-		golog.Fatal(err)
+//ListenAddr the address to listen on
+func (c *Config) ListenAddr() string {
+	if c.Listen != "" {
+		return c.Listen
 	}
-	err = readNodeInfo()
+	return net.JoinHostPort("", strconv.Itoa(c.Port))
+}
+
+//AdvertiseAddr the address other nodes dial
+func (c *Config) AdvertiseAddr() string {
+	if c.Advertise != "" {
+		return c.Advertise
+	}
+	host, port, err := net.SplitHostPort(c.ListenAddr())
 	if err != nil {
-		golog.Fatal(err)
+		port = strconv.Itoa(c.Port)
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = ""
 	}
+	return net.JoinHostPort(host, port)
 }
-func readConfig() error {
-	data, err := ioutil.ReadFile("./config.json")
+
+//RoutesFile the snapshot of the kbucket
+func (c *Config) RoutesFile() string {
+	return filepath.Join(c.DataDir, "routes.json")
+}
+
+//Load build the configuration from the defaults, the config file, the
+//environment and the flags in args, the config file is given by -config or
+//KAD_CONFIG, otherwise ./config.json is read if it exists
+func Load(args []string) (*Config, error) {
+	c := Default()
+	fs, file := c.flags()
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	path := *file
+	if !set["config"] {
+		path = os.Getenv(EnvPrefix + "CONFIG")
+	}
+	if path != "" {
+		if err := c.LoadFile(path); err != nil {
+			return nil, err
+		}
+	} else if err := c.LoadFile(DefaultFile); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := c.LoadEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+	//parse again so the flags override the file and the environment
+	fs, _ = c.flags()
+	fs.Parse(args)
+	return c, c.Validate()
+}
+
+//flags the flagset setting c, with the -config flag which only Load uses
+func (c *Config) flags() (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("kad", flag.ContinueOnError)
+	file := fs.String("config", "", "config file, .json, .yaml, .yml or .toml")
+	fs.IntVar(&c.Port, "port", c.Port, "server port")
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address to listen on, like [::]:15200")
+	fs.StringVar(&c.Advertise, "advertise", c.Advertise, "address other nodes dial")
+	fs.Var((*list)(&c.Seeds), "seeds", "comma separated addresses of the seeds")
+	fs.StringVar(&c.Network, "network", c.Network, "transport of rpcs, tcp or udp")
+	fs.BoolVar(&c.Plaintext, "plaintext", c.Plaintext, "turn off tls, required by udp")
+	fs.IntVar(&c.IDBits, "idbits", c.IDBits, "width of nodeids in bits, 128, 160 or 256")
+	fs.StringVar(&c.IdentityFile, "identity", c.IdentityFile, "file of the private key")
+	fs.StringVar(&c.DataDir, "datadir", c.DataDir, "directory of the node data")
+	fs.IntVar(&c.SubnetBucket, "subnetbucket", c.SubnetBucket, "contacts of a subnet per bucket, 0 for no limit")
+	fs.IntVar(&c.SubnetTable, "subnettable", c.SubnetTable, "contacts of a subnet in the kbucket, 0 for no limit")
+	fs.IntVar(&c.DisjointPaths, "disjointpaths", c.DisjointPaths, "disjoint paths of a lookup, 1 for a plain lookup")
+	fs.IntVar(&c.Difficulty, "difficulty", c.Difficulty, "leading zero bits of the puzzle a nodeid solves")
+	return fs, file
+}
+
+//LoadFile read the file at path, the format is chosen by the extension
+func (c *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
-	var config struct {
-		Port  int      `json:"port"`
-		Seeds []string `json:"seeds"`
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		return dec.Decode(c)
+	case ".yaml", ".yml":
+		kv, err := parseYAML(data)
+		if err != nil {
+			return err
+		}
+		return c.setAll(kv)
+	case ".toml":
+		kv, err := parseTOML(data)
+		if err != nil {
+			return err
+		}
+		return c.setAll(kv)
 	}
-	err = json.Unmarshal(data, &config)
-	if err != nil {
-		golog.Error(err)
+	return errors.New("unknown config format: " + path)
+}
+
+//LoadEnv read the variables named like the json keys with the KAD_ prefix,
+//getenv is usually os.Getenv
+func (c *Config) LoadEnv(getenv func(string) string) error {
+	for _, key := range keys {
+		v := getenv(EnvPrefix + strings.ToUpper(key))
+		if v == "" {
+			continue
+		}
+		if err := c.set(key, strings.Split(v, ",")); err != nil {
+			return err
+		}
 	}
-	Port = config.Port
-	Seeds = config.Seeds
 	return nil
 }
 
-func readNodeInfo() error {
-	data, err := ioutil.ReadFile("./node.json")
-	if err != nil {
-		return err
+//keys the keys of the settings, the same in every source
+var keys = []string{"port", "listen", "advertise", "seeds", "network", "plaintext", "idbits", "identity", "datadir", "subnetbucket", "subnettable", "disjointpaths", "difficulty"}
+
+func (c *Config) setAll(kv map[string][]string) error {
+	for k, v := range kv {
+		if err := c.set(k, v); err != nil {
+			return err
+		}
 	}
-	var config struct {
-		NodeID string `json:"NodeID"`
+	return nil
+}
+
+//set one setting from its values, only seeds takes more than one
+func (c *Config) set(key string, vals []string) error {
+	if key == "seeds" {
+		c.Seeds = []string{}
+		for _, v := range vals {
+			if v = strings.TrimSpace(v); v != "" {
+				c.Seeds = append(c.Seeds, v)
+			}
+		}
+		return nil
 	}
-	err = json.Unmarshal(data, &config)
-	if err != nil {
-		golog.Error(err)
+	if len(vals) != 1 {
+		return errors.New("config " + key + " takes one value")
+	}
+	v := strings.TrimSpace(vals[0])
+	var err error
+	switch key {
+	case "port":
+		c.Port, err = strconv.Atoi(v)
+	case "listen":
+		c.Listen = v
+	case "advertise":
+		c.Advertise = v
+	case "network":
+		c.Network = v
+	case "plaintext":
+		c.Plaintext, err = strconv.ParseBool(v)
+	case "idbits":
+		c.IDBits, err = strconv.Atoi(v)
+	case "identity":
+		c.IdentityFile = v
+	case "datadir":
+		c.DataDir = v
+	case "subnetbucket":
+		c.SubnetBucket, err = strconv.Atoi(v)
+	case "subnettable":
+		c.SubnetTable, err = strconv.Atoi(v)
+	case "disjointpaths":
+		c.DisjointPaths, err = strconv.Atoi(v)
+	case "difficulty":
+		c.Difficulty, err = strconv.Atoi(v)
+	default:
+		return errors.New("unknown config key: " + key)
 	}
-	NodeID, err = node.NewIDFromString(config.NodeID)
 	if err != nil {
-		golog.Error(err)
-		NodeID = node.NewNodeID()
-		persist()
+		return errors.New("config " + key + ": " + err.Error())
 	}
 	return nil
 }
-func persist() {
-	info := struct {
-		NodeID string `json:"NodeID"`
-	}{
-		NodeID: NodeID.String(),
+
+//Validate check the settings, it does not touch the files
+func (c *Config) Validate() error {
+	if c.Port <= 0 || 65535 < c.Port {
+		return errors.New("invalid port: " + strconv.Itoa(c.Port))
 	}
-	data, err := json.Marshal(info)
-	if err != nil {
-		golog.Error(err)
+	for _, addr := range []string{c.ListenAddr(), c.AdvertiseAddr()} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return err
+		}
 	}
-	err = ioutil.WriteFile("./node.json", data, 0644)
-	if err != nil {
-		golog.Error(err)
+	if c.Network != "tcp" && c.Network != "udp" {
+		return errors.New("invalid network: " + c.Network)
+	}
+	if c.Network == "udp" && !c.Plaintext {
+		return errors.New("udp has no transport security, it needs plaintext")
+	}
+	if c.IDBits != 128 && c.IDBits != 160 && c.IDBits != 256 {
+		return errors.New("invalid idbits: " + strconv.Itoa(c.IDBits))
 	}
+	if c.SubnetBucket < 0 || c.SubnetTable < 0 {
+		return errors.New("invalid subnet limit")
+	}
+	if c.DisjointPaths < 1 {
+		return errors.New("invalid disjointpaths: " + strconv.Itoa(c.DisjointPaths))
+	}
+	if c.Difficulty < 0 || node.MaxDifficulty < c.Difficulty {
+		return errors.New("invalid difficulty: " + strconv.Itoa(c.Difficulty))
+	}
+	if c.IdentityFile == "" {
+		return errors.New("no identity file")
+	}
+	return nil
+}
+
+//list a flag of comma separated values
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(v string) error {
+	*l = []string{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
 }
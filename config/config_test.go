@@ -0,0 +1,82 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"c.json": `{"port": 15300, "seeds": ["10.0.0.1:15200", "10.0.0.2:15200"], "network": "udp"}`,
+		"c.yaml": "# node\nport: 15300\nnetwork: 'udp'\nseeds:\n  - 10.0.0.1:15200\n  - \"10.0.0.2:15200\" # second\n",
+		"c.toml": "port = 15300\nnetwork = \"udp\" # rpc\nseeds = [\"10.0.0.1:15200\", \"10.0.0.2:15200\"]\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c := Default()
+		if err := c.LoadFile(path); err != nil {
+			t.Error("[Config.LoadFile] ", name, ": ", err)
+			continue
+		}
+		if c.Port != 15300 || c.Network != "udp" || len(c.Seeds) != 2 || c.Seeds[1] != "10.0.0.2:15200" {
+			t.Error("[Config.LoadFile] ", name, " loaded ", *c)
+		}
+		if c.IDBits != 160 {
+			t.Error("[Config.LoadFile] ", name, " changed a setting it does not have")
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "c.toml")
+	content := "port = 15300\nnetwork = \"udp\"\nidbits = 128\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("KAD_PORT", "15400")
+	os.Setenv("KAD_NETWORK", "tcp")
+	defer os.Unsetenv("KAD_PORT")
+	defer os.Unsetenv("KAD_NETWORK")
+	c, err := Load([]string{"-config", path, "-port", "15500"})
+	if err != nil {
+		t.Fatal("[Load] ", err)
+	}
+	if c.IDBits != 128 {
+		t.Error("[Load] the file is not applied")
+	}
+	if c.Network != "tcp" {
+		t.Error("[Load] the environment does not override the file")
+	}
+	if c.Port != 15500 {
+		t.Error("[Load] the flags do not override the environment")
+	}
+}
+
+func TestPlaintext(t *testing.T) {
+	c := Default()
+	c.Network = "udp"
+	if c.Validate() == nil {
+		t.Error("[Config.Validate] accepted udp without plaintext")
+	}
+	if err := c.set("plaintext", []string{"true"}); err != nil {
+		t.Fatal("[Config.set] ", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Error("[Config.Validate] ", err)
+	}
+}
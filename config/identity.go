@@ -0,0 +1,74 @@
+package config
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"kad/node"
+	"os"
+
+	"github.com/kataras/golog"
+)
+
+//identityFile the content of the identity file
+type identityFile struct {
+	NodeID     string `json:"NodeID"`
+	PrivateKey string `json:"PrivateKey"`
+}
+
+//LoadIdentity read the private key kept at path, a new identity solving the
+//puzzle of difficulty is generated and written to path only if the file is
+//missing or holds no key, as the legacy files with a uuid alone, a key which
+//does not solve the puzzle is an error rather than replaced, node.SetLength
+//must be called before since the nodeid depends on it
+func LoadIdentity(path string, difficulty int) (*node.Identity, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		golog.Warn("[config.loadidentity] no identity at ", path, ", generate a new one")
+		return newIdentity(path, difficulty)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info identityFile
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, errors.New("invalid identity file " + path + ": " + err.Error())
+	}
+	if info.PrivateKey == "" {
+		golog.Warn("[config.loadidentity] no private key in ", path, ", generate a new one")
+		return newIdentity(path, difficulty)
+	}
+	seed, err := hex.DecodeString(info.PrivateKey)
+	if err != nil {
+		return nil, errors.New("invalid private key in " + path + ": " + err.Error())
+	}
+	id, err := node.NewIdentityFromSeed(seed)
+	if err != nil {
+		return nil, errors.New("invalid private key in " + path + ": " + err.Error())
+	}
+	if node.Difficulty(id.PublicKey) < difficulty {
+		return nil, fmt.Errorf("the key in %s solves a puzzle of difficulty %d, %d is required", path, node.Difficulty(id.PublicKey), difficulty)
+	}
+	return id, nil
+}
+
+func newIdentity(path string, difficulty int) (*node.Identity, error) {
+	id, err := node.NewIdentityWithDifficulty(difficulty)
+	if err != nil {
+		return nil, err
+	}
+	return id, saveIdentity(path, id)
+}
+
+func saveIdentity(path string, id *node.Identity) error {
+	data, err := json.Marshal(identityFile{
+		NodeID:     id.ID.String(),
+		PrivateKey: hex.EncodeToString(id.Seed()),
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"io/ioutil"
+	"kad/node"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "node.json")
+	id, err := LoadIdentity(path, 0)
+	if err != nil {
+		t.Fatal("[LoadIdentity] ", err)
+	}
+	loaded, err := LoadIdentity(path, 0)
+	if err != nil || !loaded.ID.Equal(id.ID) {
+		t.Fatal("[LoadIdentity] saved identity not loaded again: ", err)
+	}
+	before, _ := ioutil.ReadFile(path)
+	if _, err := LoadIdentity(path, node.Difficulty(id.PublicKey)+1); err == nil {
+		t.Error("[LoadIdentity] key below the difficulty accepted")
+	}
+	after, _ := ioutil.ReadFile(path)
+	if string(before) != string(after) {
+		t.Error("[LoadIdentity] identity file overwritten")
+	}
+	ioutil.WriteFile(path, []byte("{"), 0600)
+	if _, err := LoadIdentity(path, 0); err == nil {
+		t.Error("[LoadIdentity] corrupt identity file accepted")
+	}
+	ioutil.WriteFile(path, []byte(`{"NodeID":"80847077-4e11-4419-a4c6-8ad59f848bda"}`), 0600)
+	legacy, err := LoadIdentity(path, 0)
+	if err != nil {
+		t.Fatal("[LoadIdentity] legacy identity file: ", err)
+	}
+	loaded, err = LoadIdentity(path, 0)
+	if err != nil || !loaded.ID.Equal(legacy.ID) {
+		t.Error("[LoadIdentity] key generated for a legacy file not saved: ", err)
+	}
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//the config is a flat set of scalars and lists of scalars, so only that
+//subset of yaml and toml is parsed: no nesting, tables or multiline strings
+
+//parseYAML parse "key: value" lines, a list is either inline "[a, b]" or
+//one "- item" per line below an empty "key:"
+func parseYAML(data []byte) (map[string][]string, error) {
+	kv := map[string][]string{}
+	list := ""
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" || line == "---" {
+			continue
+		}
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			if list == "" {
+				return nil, lineError("yaml", ln, "list item without a key")
+			}
+			v, err := unquote(strings.TrimSpace(strings.TrimPrefix(line, "-")))
+			if err != nil {
+				return nil, lineError("yaml", ln, err.Error())
+			}
+			kv[list] = append(kv[list], v)
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, lineError("yaml", ln, "expect key: value")
+		}
+		key := strings.TrimSpace(line[:i])
+		vals, err := parseValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, lineError("yaml", ln, err.Error())
+		}
+		list = ""
+		if vals == nil {
+			list = key
+			vals = []string{}
+		}
+		kv[key] = vals
+	}
+	return kv, sc.Err()
+}
+
+//parseTOML parse "key = value" lines, a list is an inline array
+func parseTOML(data []byte) (map[string][]string, error) {
+	kv := map[string][]string{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, lineError("toml", ln, "tables are not supported")
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, lineError("toml", ln, "expect key = value")
+		}
+		vals, err := parseValue(strings.TrimSpace(line[i+1:]))
+		if err != nil || vals == nil {
+			return nil, lineError("toml", ln, "invalid value")
+		}
+		kv[strings.TrimSpace(line[:i])] = vals
+	}
+	return kv, sc.Err()
+}
+
+//parseValue parse a scalar or an inline list, nil if v is empty
+func parseValue(v string) ([]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(v, "[") {
+		s, err := unquote(v)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+	if !strings.HasSuffix(v, "]") {
+		return nil, errors.New("unterminated list")
+	}
+	vals := []string{}
+	for _, item := range strings.Split(v[1:len(v)-1], ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		s, err := unquote(item)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, s)
+	}
+	return vals, nil
+}
+
+func unquote(v string) (string, error) {
+	if strings.HasPrefix(v, "\"") {
+		return strconv.Unquote(v)
+	}
+	if strings.HasPrefix(v, "'") {
+		if len(v) < 2 || !strings.HasSuffix(v, "'") {
+			return "", errors.New("unterminated string")
+		}
+		return v[1 : len(v)-1], nil
+	}
+	return v, nil
+}
+
+//stripComment cut a # comment which is not inside quotes
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func lineError(format string, ln int, msg string) error {
+	return errors.New(format + " line " + strconv.Itoa(ln) + ": " + msg)
+}
@@ -0,0 +1,87 @@
+package kbucket
+
+import (
+	"kad/node"
+	"net"
+	"sync/atomic"
+)
+
+//Diversity the limits on the contacts sharing a /24 for IPv4 or a /48 for
+//IPv6, so one attacker with many nodeids on a subnet can not fill the
+//buckets, 0 for no limit
+type Diversity struct {
+	//PerBucket contacts of a subnet in one bucket
+	PerBucket int
+	//PerTable contacts of a subnet in the whole table
+	PerTable int
+}
+
+//DefaultDiversity the limits of a new kbucket
+var DefaultDiversity = Diversity{
+	PerBucket: 2,
+	PerTable:  3,
+}
+
+//SetDiversity change the subnet limits, the contacts already kept stay
+func (k *Kbucket) SetDiversity(d Diversity) {
+	k.pong <- message{
+		mtype: mdiversity,
+		data:  d,
+	}
+}
+
+//Rejected how many contacts were refused for exceeding the subnet limits
+func (k *Kbucket) Rejected() uint64 {
+	return atomic.LoadUint64(&k.rejected)
+}
+
+//diverse check whether adding n to que keeps its subnet within the limits,
+//a contact already kept is not counted against itself
+func (k *Kbucket) diverse(n node.Node, que KQue) bool {
+	sub := subnet(n.Addr)
+	if sub == "" {
+		return true
+	}
+	d := k.diversity
+	if 0 < d.PerBucket && d.PerBucket <= que.countSubnet(sub, n.ID) {
+		return false
+	}
+	if d.PerTable <= 0 {
+		return true
+	}
+	count := 0
+	for _, q := range k.routes {
+		count += q.countSubnet(sub, n.ID)
+	}
+	return count < d.PerTable
+}
+
+//countSubnet the contacts and replacements of sub other than nid
+func (kq *KQue) countSubnet(sub string, nid node.NodeID) int {
+	count := 0
+	for _, ns := range [][]node.Node{kq.que, kq.replace} {
+		for _, v := range ns {
+			if !v.ID.Equal(nid) && subnet(v.Addr) == sub {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+//subnet the /24 or /48 of the host of addr, "" for the addresses which are
+//not limited: hostnames, loopback, private and link local ones
+func subnet(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
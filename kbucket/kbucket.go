@@ -4,6 +4,7 @@ import (
 	"errors"
 	"kad/node"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/kataras/golog"
@@ -16,6 +17,20 @@ type (
 		mtype mtype
 		data  interface{}
 	}
+	//findReq a query answered on the run loop
+	findReq struct {
+		nid   node.NodeID
+		count int
+		reply chan findRes
+	}
+	findRes struct {
+		ns  []node.Node
+		err error
+	}
+	idleReq struct {
+		idle  time.Duration
+		reply chan []node.NodeID
+	}
 	Kbucket struct {
 		routes map[int]KQue
 		self   *node.Node
@@ -23,29 +38,70 @@ type (
 		alpha  int
 		ticker *time.Ticker
 		pong   chan message
-		Ping   chan node.Node
+		//path the file of the snapshot, "" to keep none
+		path     string
+		saved    time.Time
+		restored []node.Node
+		//diversity the subnet limits, rejected the contacts refused by them
+		diversity Diversity
+		rejected  uint64
+		//Ping nodes the server should ping to tell whether they are alive
+		Ping chan node.Node
 	}
 )
 
 const (
-	mdelnode mtype = "deletenode"
-	maddnode mtype = "addnode"
+	mdelnode   mtype = "deletenode"
+	maddnode   mtype = "addnode"
+	mfind      mtype = "find"
+	mfindone   mtype = "findone"
+	mtouch     mtype = "touch"
+	mfail      mtype = "fail"
+	midle      mtype = "idle"
+	mdiversity mtype = "diversity"
+	msave      mtype = "save"
 )
 const (
 	kcount = 8
 	alpha  = 3
 	ticktm = 5 * time.Second
+	//pingtm how long a pinged head may take to answer before eviction
+	pingtm = 2 * ticktm
+	//savetm how often the contacts are written to the snapshot
+	savetm = time.Minute
+	//maxFailures how many requests in a row may fail before a node is removed
+	maxFailures = 3
 )
 
 //New create a kbucket
 func New(local *node.Node) *Kbucket {
+	return NewWithSnapshot(local, "")
+}
+
+//NewWithSnapshot create a kbucket which periodically writes its contacts to
+//path, the contacts of an earlier snapshot are loaded as Restored
+func NewWithSnapshot(local *node.Node, path string) *Kbucket {
 	k := &Kbucket{
-		routes: make(map[int]KQue, 64),
-		self:   local,
-		k:      kcount,
-		alpha:  alpha,
-		pong:   make(chan message),
-		Ping:   make(chan node.Node),
+		routes:    make(map[int]KQue, 64),
+		self:      local,
+		k:         kcount,
+		alpha:     alpha,
+		pong:      make(chan message),
+		Ping:      make(chan node.Node, 16),
+		path:      path,
+		saved:     time.Now(),
+		diversity: DefaultDiversity,
+	}
+	if path != "" {
+		ns, err := load(path)
+		if err != nil {
+			golog.Warn("[kbucket.new] load snapshot: ", err)
+		}
+		for _, n := range ns {
+			if !n.ID.Equal(local.ID) {
+				k.restored = append(k.restored, n)
+			}
+		}
 	}
 	k.ticker = time.NewTicker(ticktm)
 	go k.run()
@@ -55,8 +111,12 @@ func New(local *node.Node) *Kbucket {
 func (k *Kbucket) run() {
 	for {
 		select {
-		case <-k.ticker.C:
+		case now := <-k.ticker.C:
 			golog.Info("[kbucket.run] routes: ", k.routes)
+			k.expire(now)
+			if savetm <= now.Sub(k.saved) {
+				k.persist(now)
+			}
 		case msg := <-k.pong:
 			switch msg.mtype {
 			case maddnode:
@@ -65,12 +125,118 @@ func (k *Kbucket) run() {
 			case mdelnode:
 				n := msg.data.(node.Node)
 				k.remove(n)
+			case mfind:
+				req := msg.data.(findReq)
+				ns, err := k.findN(req.nid, req.count)
+				req.reply <- findRes{ns: ns, err: err}
+			case mfindone:
+				req := msg.data.(findReq)
+				n, err := k.findOne(req.nid)
+				req.reply <- findRes{ns: []node.Node{n}, err: err}
+			case mtouch:
+				k.touch(msg.data.(node.NodeID), time.Now())
+			case mfail:
+				k.fail(msg.data.(node.NodeID))
+			case midle:
+				req := msg.data.(idleReq)
+				req.reply <- k.idle(req.idle, time.Now())
+			case mdiversity:
+				k.diversity = msg.data.(Diversity)
+			case msave:
+				msg.data.(chan error) <- k.persist(time.Now())
 			}
 		}
 	}
 }
 
-//AddNode to add a node
+//ping ask the server to ping n, false if the request queue is full
+func (k *Kbucket) ping(n node.Node) bool {
+	select {
+	case k.Ping <- n:
+		return true
+	default:
+		golog.Warn("[kbucket.ping] ping queue full, skip: ", n.Addr)
+		return false
+	}
+}
+
+func (k *Kbucket) expire(now time.Time) {
+	for p, que := range k.routes {
+		que.expire(now, pingtm)
+		k.routes[p] = que
+	}
+}
+
+//Touch record a lookup of nid, which refreshes the bucket covering it
+func (k *Kbucket) Touch(nid node.NodeID) {
+	k.pong <- message{
+		mtype: mtouch,
+		data:  nid,
+	}
+}
+
+func (k *Kbucket) touch(nid node.NodeID, now time.Time) {
+	distance, err := node.CalDistance(nid, k.self.ID)
+	if err != nil {
+		golog.Error(err)
+		return
+	}
+	partion := distance.Partion()
+	if que, ok := k.routes[partion]; ok {
+		que.touched = now
+		k.routes[partion] = que
+	}
+}
+
+//Idle a random id in the range of every bucket without lookups for longer
+//than idle, looking them up refreshes the buckets
+func (k *Kbucket) Idle(idle time.Duration) []node.NodeID {
+	reply := make(chan []node.NodeID, 1)
+	k.pong <- message{
+		mtype: midle,
+		data: idleReq{
+			idle:  idle,
+			reply: reply,
+		},
+	}
+	return <-reply
+}
+
+func (k *Kbucket) idle(idle time.Duration, now time.Time) []node.NodeID {
+	ids := []node.NodeID{}
+	for p, que := range k.routes {
+		if now.Sub(que.touched) < idle {
+			continue
+		}
+		ids = append(ids, node.NewIDInPartion(k.self.ID, p))
+		que.touched = now
+		k.routes[p] = que
+	}
+	return ids
+}
+
+//Failed record a failed request to nid
+func (k *Kbucket) Failed(nid node.NodeID) {
+	k.pong <- message{
+		mtype: mfail,
+		data:  nid,
+	}
+}
+
+func (k *Kbucket) fail(nid node.NodeID) {
+	distance, err := node.CalDistance(nid, k.self.ID)
+	if err != nil {
+		golog.Error(err)
+		return
+	}
+	partion := distance.Partion()
+	if que, ok := k.routes[partion]; ok {
+		que.fail(nid)
+		k.routes[partion] = que
+	}
+}
+
+//AddNode to add a node, a node seen again keeps the average of its rtt
 func (k *Kbucket) AddNode(n node.Node) {
 	k.pong <- message{
 		mtype: maddnode,
@@ -89,6 +255,11 @@ func (k *Kbucket) add(n node.Node) {
 	} else {
 		que = k.routes[partion]
 	}
+	if !que.has(n) && !k.diverse(n, que) {
+		atomic.AddUint64(&k.rejected, 1)
+		golog.Warn("[kbucket.add] too many contacts in the subnet of ", n.Addr)
+		return
+	}
 	qptr := &que
 	qptr.updateAdd(n)
 	k.routes[partion] = que
@@ -117,52 +288,80 @@ func (k *Kbucket) remove(n node.Node) {
 	return
 }
 
+//K the bucket size, also the number of contacts a lookup converges to
+func (k *Kbucket) K() int {
+	return k.k
+}
+
+//Alpha the parallelism of a lookup
+func (k *Kbucket) Alpha() int {
+	return k.alpha
+}
+
+//Find to find alpha of the k closest nodes in the table, the ones with the
+//lowest rtt among the about as close ones
 func (k *Kbucket) Find(nid node.NodeID) (ns []node.Node, err error) {
-	dist, err := node.CalDistance(nid, k.self.ID)
+	ns, err = k.FindN(nid, k.k)
 	if err != nil {
-		golog.Error(err)
-		return []node.Node{}, err
-	}
-	partion := dist.Partion()
-	if kq, ok := k.routes[partion]; ok {
-		ns, err := kq.findN(nid, k.alpha)
-		if err != nil {
-			return ns, err
-		}
+		return ns, err
 	}
-	if k.alpha <= len(ns) {
-		return ns, nil
+	node.SortByProximity(ns, nid)
+	if k.alpha < len(ns) {
+		ns = ns[:k.alpha]
 	}
-	pslice := make([]int, len(k.routes))
-	i := 0
-	for key := range k.routes {
-		pslice[i] = key
-		i++
+	return ns, nil
+}
+
+//query run a find on the run loop, so it never races with add and remove
+func (k *Kbucket) query(mt mtype, nid node.NodeID, count int) findRes {
+	reply := make(chan findRes, 1)
+	k.pong <- message{
+		mtype: mt,
+		data: findReq{
+			nid:   nid,
+			count: count,
+			reply: reply,
+		},
 	}
-	p := Partions{
-		parts: pslice,
-		base:  partion,
+	return <-reply
+}
+
+//FindN to find at most count closest nodes in the table
+func (k *Kbucket) FindN(nid node.NodeID, count int) ([]node.Node, error) {
+	res := k.query(mfind, nid, count)
+	return res.ns, res.err
+}
+
+func (k *Kbucket) findN(nid node.NodeID, count int) (ns []node.Node, err error) {
+	if count <= 0 {
+		return []node.Node{}, nil
 	}
-	sort.Sort(p)
-	for _, v := range p.parts {
-		kq, ok := k.routes[v]
-		if ok {
-			res, err := kq.findN(nid, k.alpha-len(ns))
-			if err != nil {
-				return ns, err
-			}
-			for _, v := range res {
-				ns = append(ns, v)
-			}
-			if k.alpha <= len(ns) {
-				break
-			}
+	ns = k.contacts()
+	dists := make(map[node.NodeID]node.Distance, len(ns))
+	for _, n := range ns {
+		d, err := node.CalDistance(n.ID, nid)
+		if err != nil {
+			golog.Error(err)
+			return []node.Node{}, err
 		}
+		dists[n.ID] = d
+	}
+	sort.Slice(ns, func(i, j int) bool {
+		return dists[ns[i].ID].Compare(dists[ns[j].ID]) < 0
+	})
+	if count < len(ns) {
+		ns = ns[:count]
 	}
 	return ns, nil
 }
 
+//FindOne to find the closest node in the table
 func (k *Kbucket) FindOne(nid node.NodeID) (node.Node, error) {
+	res := k.query(mfindone, nid, 1)
+	return res.ns[0], res.err
+}
+
+func (k *Kbucket) findOne(nid node.NodeID) (node.Node, error) {
 	dist, err := node.CalDistance(nid, k.self.ID)
 	if err != nil {
 		golog.Error(err)
@@ -1,8 +1,11 @@
 package kbucket
 
 import (
+	"fmt"
 	"kad/node"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestFind(t *testing.T) {
@@ -52,3 +55,140 @@ func TestFind(t *testing.T) {
 		t.Error("[Kbucket.FindOne] closest one != 'addr3'")
 	}
 }
+
+//TestConcurrentFind run with -race to check queries never race with updates
+func TestConcurrentFind(t *testing.T) {
+	self := node.Node{
+		ID:   node.NewNodeID(),
+		Addr: "addr",
+	}
+	k := New(&self)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				n := node.Node{
+					ID:   node.NewNodeID(),
+					Addr: fmt.Sprintf("addr%d-%d", i, j),
+				}
+				k.AddNode(n)
+				if j%3 == 0 {
+					k.RemoveNode(n)
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := k.FindN(node.NewNodeID(), kcount); err != nil {
+					t.Error("[Kbucket.FindN] ", err)
+				}
+				k.FindOne(node.NewNodeID())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestIdle(t *testing.T) {
+	self := node.Node{
+		ID:   node.NewNodeID(),
+		Addr: "addr",
+	}
+	k := New(&self)
+	n := node.Node{
+		ID:   node.NewIDInPartion(self.ID, 100),
+		Addr: "addr0",
+	}
+	k.AddNode(n)
+	if len(k.Idle(time.Hour)) != 0 {
+		t.Error("[Kbucket.Idle] new bucket is idle")
+	}
+	ids := k.Idle(0)
+	if len(ids) != 1 {
+		t.Fatal("[Kbucket.Idle] idle buckets != 1")
+	}
+	d, _ := node.CalDistance(self.ID, ids[0])
+	if d.Partion() != 100 {
+		t.Error("[Kbucket.Idle] refresh id is out of the bucket")
+	}
+	k.Touch(n.ID)
+	if len(k.Idle(time.Minute)) != 0 {
+		t.Error("[Kbucket.Touch] touched bucket is idle")
+	}
+}
+
+func TestFailed(t *testing.T) {
+	self := node.Node{
+		ID:   node.NewNodeID(),
+		Addr: "addr",
+	}
+	k := New(&self)
+	n := node.Node{
+		ID:   node.NewIDInPartion(self.ID, 100),
+		Addr: "addr0",
+		RTT:  80 * time.Millisecond,
+	}
+	k.AddNode(n)
+	n.RTT = 160 * time.Millisecond
+	k.AddNode(n)
+	found, err := k.FindOne(n.ID)
+	if err != nil || found.RTT != 90*time.Millisecond {
+		t.Error("[Kbucket.AddNode] rtt ", found.RTT, " is not the average")
+	}
+	for i := 0; i < maxFailures-1; i++ {
+		k.Failed(n.ID)
+	}
+	if found, _ := k.FindOne(n.ID); !found.ID.Equal(n.ID) || found.Failures != maxFailures-1 {
+		t.Error("[Kbucket.Failed] failures not counted")
+	}
+	k.Failed(n.ID)
+	if ns, _ := k.FindN(n.ID, kcount); len(ns) != 0 {
+		t.Error("[Kbucket.Failed] failing node not removed")
+	}
+}
+
+func TestDiversity(t *testing.T) {
+	self := node.Node{
+		ID:   node.NewNodeID(),
+		Addr: "addr",
+	}
+	k := New(&self)
+	add := func(partion int, addr string) node.Node {
+		n := node.Node{
+			ID:   node.NewIDInPartion(self.ID, partion),
+			Addr: addr,
+		}
+		k.AddNode(n)
+		return n
+	}
+	add(100, "203.0.113.1:15200")
+	add(100, "203.0.113.2:15200")
+	n := add(100, "203.0.113.3:15200")
+	if found, _ := k.FindOne(n.ID); found.ID.Equal(n.ID) {
+		t.Error("[Kbucket.AddNode] third contact of a /24 kept in one bucket")
+	}
+	add(90, "203.0.113.4:15200")
+	n = add(80, "203.0.113.5:15200")
+	if found, _ := k.FindOne(n.ID); found.ID.Equal(n.ID) {
+		t.Error("[Kbucket.AddNode] fourth contact of a /24 kept in the table")
+	}
+	if k.Rejected() != 2 {
+		t.Error("[Kbucket.Rejected] ", k.Rejected(), " rejected, want 2")
+	}
+	add(100, "[2001:db8:1:2::1]:15200")
+	add(100, "[2001:db8:1:3::1]:15200")
+	add(100, "[2001:db8:1:4::1]:15200")
+	add(100, "10.0.0.1:15200")
+	add(100, "10.0.0.2:15200")
+	if k.Rejected() != 3 {
+		t.Error("[Kbucket.Rejected] ", k.Rejected(), " rejected, want 3")
+	}
+	k.SetDiversity(Diversity{})
+	n = add(100, "203.0.113.6:15200")
+	if found, _ := k.FindOne(n.ID); !found.ID.Equal(n.ID) {
+		t.Error("[Kbucket.SetDiversity] contact rejected without limits")
+	}
+}
@@ -1,23 +1,30 @@
 package kbucket
 
 import (
-	"fmt"
 	"kad/node"
+	"time"
 
 	"github.com/kataras/golog"
 )
 
+//KQue a bucket ordered from least to most recently seen, with a cache of
+//candidates to replace nodes which stop answering
 type KQue struct {
-	que    []node.Node
-	k      int
-	bucket *Kbucket
+	que     []node.Node
+	replace []node.Node
+	pinged  time.Time
+	touched time.Time
+	k       int
+	bucket  *Kbucket
 }
 
 func newKQue(k *Kbucket) KQue {
 	return KQue{
-		que:    make([]node.Node, 0, k.k),
-		k:      k.k,
-		bucket: k,
+		que:     make([]node.Node, 0, k.k),
+		replace: make([]node.Node, 0, k.k),
+		touched: time.Now(),
+		k:       k.k,
+		bucket:  k,
 	}
 }
 
@@ -25,22 +32,6 @@ func (kq *KQue) count() int {
 	return len(kq.que)
 }
 
-func (kq *KQue) findN(nid node.NodeID, n int) ([]node.Node, error) {
-	if kq.count() <= n {
-		res := make([]node.Node, kq.count())
-		for i, v := range kq.que {
-			res[i] = v
-		}
-		return res, nil
-	}
-	li, err := findClosestN(n, nid, kq.que)
-	fmt.Println(li)
-	if err != nil {
-		return []node.Node{}, err
-	}
-	return li, nil
-}
-
 func (kq *KQue) findOne(nid node.NodeID) (bool, node.Node) {
 	if kq.count() == 0 {
 		return false, node.Node{}
@@ -69,12 +60,18 @@ func (kq *KQue) update(n node.Node) {
 	for _, v := range kq.que {
 		if !v.ID.Equal(n.ID) {
 			arr = append(arr, v)
+		} else {
+			n.RTT = node.EWMA(v.RTT, n.RTT)
 		}
 	}
 	arr = append(arr, n)
 	kq.que = arr
 }
+
+//updateAdd move a seen node to the tail, when the bucket is full the newcomer
+//goes to the replacement cache and the least recently seen node is pinged
 func (kq *KQue) updateAdd(n node.Node) {
+	n.LastSeen = time.Now()
 	if kq.has(n) {
 		kq.update(n)
 		return
@@ -83,15 +80,72 @@ func (kq *KQue) updateAdd(n node.Node) {
 		kq.que = append(kq.que, n)
 		return
 	}
+	kq.addReplacement(n)
 	head := kq.que[0]
 	if head.State == node.NSWaitPong {
-		kq.update(head)
 		return
 	}
-	if head.State == node.NSNil {
+	if kq.bucket.ping(head) {
 		head.State = node.NSWaitPong
 		kq.que[0] = head
-		kq.bucket.Ping <- head
+		kq.pinged = time.Now()
+	}
+}
+
+//addReplacement keep n as the freshest candidate, forgetting the stalest one
+//when the cache is full
+func (kq *KQue) addReplacement(n node.Node) {
+	arr := []node.Node{}
+	for _, v := range kq.replace {
+		if !v.ID.Equal(n.ID) {
+			arr = append(arr, v)
+		}
+	}
+	arr = append(arr, n)
+	if kq.k < len(arr) {
+		arr = arr[len(arr)-kq.k:]
+	}
+	kq.replace = arr
+}
+
+//promote move the freshest replacement into the bucket
+func (kq *KQue) promote() {
+	if len(kq.replace) == 0 || kq.k <= kq.count() {
+		return
+	}
+	n := kq.replace[len(kq.replace)-1]
+	kq.replace = kq.replace[:len(kq.replace)-1]
+	n.State = node.NSNil
+	kq.que = append(kq.que, n)
+}
+
+//expire evict the head if it has not answered its ping within timeout
+func (kq *KQue) expire(now time.Time, timeout time.Duration) {
+	if kq.count() == 0 || kq.que[0].State != node.NSWaitPong {
+		return
+	}
+	if now.Sub(kq.pinged) < timeout {
+		return
+	}
+	golog.Info("[kque.expire] evict unresponsive node: ", kq.que[0].Addr)
+	kq.que = kq.que[1:]
+	kq.promote()
+}
+
+//fail count a failed request to nid, the node is removed after maxFailures
+//failures in a row
+func (kq *KQue) fail(nid node.NodeID) {
+	for i, v := range kq.que {
+		if !v.ID.Equal(nid) {
+			continue
+		}
+		v.Failures++
+		kq.que[i] = v
+		if maxFailures <= v.Failures {
+			golog.Info("[kque.fail] remove failing node: ", v.Addr)
+			kq.remove(v)
+		}
+		return
 	}
 }
 
@@ -106,6 +160,7 @@ func (kq *KQue) remove(n node.Node) {
 		}
 	}
 	kq.que = arr
+	kq.promote()
 }
 
 func findClosestOne(nid node.NodeID, nodes []node.Node) ([]node.Node, error) {
@@ -1,8 +1,10 @@
 package kbucket
 
 import (
+	"fmt"
 	"kad/node"
 	"testing"
+	"time"
 )
 
 func TestFindClosestN(t *testing.T) {
@@ -126,11 +128,70 @@ func TestFindOne(t *testing.T) {
 		kq.updateAdd(v)
 	}
 	nid, _ := node.NewIDFromString("00000000-0000-0000-0000-000000000005")
-	res, e := kq.findN(nid, 3)
-	if e != nil {
-		t.Error("[kQue.findN] find error", e)
+	ok, res := kq.findOne(nid)
+	if !ok {
+		t.Fatal("[kQue.findOne] nothing found")
 	}
-	if len(res) != 3 {
-		t.Error("[kQUe.findN] find count != 3")
+	if !res.ID.Equal(id3) {
+		t.Error("[kQue.findOne] closest != '0004'")
+	}
+}
+
+func fullKQue(t *testing.T) (*Kbucket, KQue, node.Node) {
+	id, _ := node.NewIDFromString("00000000-0000-0000-0000-000000000000")
+	k := New(&node.Node{
+		ID:   id,
+		Addr: "addr",
+	})
+	kq := newKQue(k)
+	for i := 0; i < kcount; i++ {
+		nid, _ := node.NewIDFromString(fmt.Sprintf("80000000-0000-0000-0000-00000000000%d", i))
+		kq.updateAdd(node.Node{
+			ID:   nid,
+			Addr: fmt.Sprintf("addr%d", i),
+		})
+	}
+	nid, _ := node.NewIDFromString("80000000-0000-0000-0000-000000000009")
+	newcomer := node.Node{
+		ID:   nid,
+		Addr: "addr9",
+	}
+	kq.updateAdd(newcomer)
+	if kq.count() != kcount || len(kq.replace) != 1 {
+		t.Fatal("[kQue.updateAdd] newcomer not kept as replacement")
+	}
+	head := <-k.Ping
+	if head.Addr != "addr0" || kq.que[0].State != node.NSWaitPong {
+		t.Fatal("[kQue.updateAdd] head not pinged")
+	}
+	return k, kq, newcomer
+}
+
+func TestEvict(t *testing.T) {
+	_, kq, newcomer := fullKQue(t)
+	kq.expire(time.Now(), pingtm)
+	if kq.que[0].Addr != "addr0" {
+		t.Error("[kQue.expire] head evicted before timeout")
+	}
+	kq.expire(time.Now().Add(pingtm), pingtm)
+	if kq.count() != kcount || kq.que[0].Addr != "addr1" {
+		t.Error("[kQue.expire] unresponsive head not evicted")
+	}
+	if !kq.que[kcount-1].ID.Equal(newcomer.ID) || len(kq.replace) != 0 {
+		t.Error("[kQue.expire] replacement not promoted")
+	}
+}
+
+func TestPongMovesHead(t *testing.T) {
+	_, kq, _ := fullKQue(t)
+	head := kq.que[0]
+	head.State = node.NSNil
+	kq.updateAdd(head)
+	if kq.que[kcount-1].Addr != "addr0" || kq.que[kcount-1].State != node.NSNil {
+		t.Error("[kQue.updateAdd] answered head not moved to the tail")
+	}
+	kq.expire(time.Now().Add(pingtm), pingtm)
+	if kq.count() != kcount || len(kq.replace) != 1 {
+		t.Error("[kQue.expire] evicted a node that answered")
 	}
 }
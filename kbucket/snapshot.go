@@ -0,0 +1,111 @@
+package kbucket
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"kad/node"
+	"os"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+//contact a node as written to the snapshot
+type contact struct {
+	ID       string        `json:"id"`
+	Addr     string        `json:"addr"`
+	LastSeen time.Time     `json:"lastseen"`
+	RTT      time.Duration `json:"rtt"`
+}
+
+//Restored the contacts of the snapshot loaded by NewWithSnapshot, they are
+//not in the table until a ping proves they are alive
+func (k *Kbucket) Restored() []node.Node {
+	return k.restored
+}
+
+//contacts every node in the table
+func (k *Kbucket) contacts() []node.Node {
+	ns := []node.Node{}
+	for _, que := range k.routes {
+		ns = append(ns, que.que...)
+	}
+	return ns
+}
+
+//Save write the contacts to the snapshot now, the server calls it on
+//shutdown, it does nothing for a kbucket without snapshot
+func (k *Kbucket) Save() error {
+	reply := make(chan error, 1)
+	k.pong <- message{
+		mtype: msave,
+		data:  reply,
+	}
+	return <-reply
+}
+
+//persist write the contacts to the snapshot if the kbucket keeps one
+func (k *Kbucket) persist(now time.Time) error {
+	if k.path == "" {
+		return nil
+	}
+	k.saved = now
+	if err := save(k.path, k.contacts()); err != nil {
+		golog.Error("[kbucket.persist] ", err)
+		return err
+	}
+	return nil
+}
+
+//save write ns to path, through a temporary file so a crash never leaves a
+//truncated snapshot
+func save(path string, ns []node.Node) error {
+	cs := make([]contact, len(ns))
+	for i, n := range ns {
+		cs[i] = contact{
+			ID:       n.ID.String(),
+			Addr:     n.Addr,
+			LastSeen: n.LastSeen,
+			RTT:      n.RTT,
+		}
+	}
+	data, err := json.Marshal(cs)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//load read the contacts saved at path, a missing file is an empty snapshot
+func load(path string) ([]node.Node, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cs []contact
+	if err := json.Unmarshal(data, &cs); err != nil {
+		return nil, err
+	}
+	ns := make([]node.Node, 0, len(cs))
+	for _, c := range cs {
+		id, err := node.NewIDFromString(c.ID)
+		if err != nil {
+			golog.Warn("[kbucket.load] skip contact ", c.Addr, ": ", err)
+			continue
+		}
+		ns = append(ns, node.Node{
+			ID:       id,
+			Addr:     c.Addr,
+			LastSeen: c.LastSeen,
+			RTT:      c.RTT,
+		})
+	}
+	return ns, nil
+}
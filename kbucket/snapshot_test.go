@@ -0,0 +1,71 @@
+package kbucket
+
+import (
+	"io/ioutil"
+	"kad/node"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.json")
+	self := node.Node{ID: node.NewNodeID(), Addr: "self"}
+	ns := []node.Node{
+		self,
+		node.Node{ID: node.NewNodeID(), Addr: "addr0", LastSeen: time.Unix(100, 0), RTT: time.Millisecond},
+		node.Node{ID: node.NewNodeID(), Addr: "addr1", LastSeen: time.Unix(200, 0)},
+	}
+	if err := save(path, ns); err != nil {
+		t.Fatal("[save] ", err)
+	}
+	k := NewWithSnapshot(&self, path)
+	restored := k.Restored()
+	if len(restored) != 2 {
+		t.Fatal("[NewWithSnapshot] restored ", len(restored), " contacts, want 2")
+	}
+	for i, n := range restored {
+		want := ns[i+1]
+		if !n.ID.Equal(want.ID) || n.Addr != want.Addr || !n.LastSeen.Equal(want.LastSeen) || n.RTT != want.RTT {
+			t.Error("[NewWithSnapshot] contact ", i, " != saved one")
+		}
+	}
+	if ns, _ := k.FindN(self.ID, 8); len(ns) != 0 {
+		t.Error("[NewWithSnapshot] restored contacts are live before a ping")
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.json")
+	self := node.Node{ID: node.NewNodeID(), Addr: "self"}
+	k := NewWithSnapshot(&self, path)
+	ids := map[node.NodeID]bool{}
+	for i := 0; i < 3; i++ {
+		n := node.Node{ID: node.NewIDInPartion(self.ID, 100+i), Addr: "addr"}
+		ids[n.ID] = true
+		k.AddNode(n)
+	}
+	if err := k.Save(); err != nil {
+		t.Fatal("[Kbucket.Save] ", err)
+	}
+	restored := NewWithSnapshot(&self, path).Restored()
+	if len(restored) != len(ids) {
+		t.Fatal("[Kbucket.Save] reloaded ", len(restored), " contacts, want ", len(ids))
+	}
+	for _, n := range restored {
+		if !ids[n.ID] {
+			t.Error("[Kbucket.Save] reloaded a contact never added")
+		}
+	}
+}
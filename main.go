@@ -1,31 +1,50 @@
 package main
 
 import (
-	"fmt"
 	"kad/config"
 	"kad/kbucket"
 	"kad/node"
 	"kad/server"
+	"os"
 
 	"github.com/kataras/golog"
 )
 
-const (
-	localhost = "127.0.0.1"
-)
-
 func main() {
-	golog.Info("nodeid: " + string(config.NodeID.String()))
+	conf, err := config.Load(os.Args[1:])
+	if err != nil {
+		golog.Fatal(err)
+	}
+	if err := node.SetLength(conf.IDBits); err != nil {
+		golog.Fatal(err)
+	}
+	if err := os.MkdirAll(conf.DataDir, 0700); err != nil {
+		golog.Fatal(err)
+	}
+	id, err := config.LoadIdentity(conf.IdentityFile, conf.Difficulty)
+	if err != nil {
+		golog.Fatal(err)
+	}
+	golog.Info("nodeid: " + id.ID.String())
 	n := &node.Node{
-		Addr: fmt.Sprintf("%s:%d", localhost, config.Port),
-		ID:   config.NodeID,
+		Addr: conf.AdvertiseAddr(),
+		ID:   id.ID,
 	}
-	bucket := kbucket.New(n)
+	bucket := kbucket.NewWithSnapshot(n, conf.RoutesFile())
+	bucket.SetDiversity(kbucket.Diversity{
+		PerBucket: conf.SubnetBucket,
+		PerTable:  conf.SubnetTable,
+	})
 	s := server.Config{
-		Addr:    fmt.Sprintf("%s:%d", localhost, config.Port),
-		ID:      config.NodeID,
-		Kbucket: bucket,
-		Seeds:   config.Seeds,
+		Addr:          conf.ListenAddr(),
+		Advertise:     conf.AdvertiseAddr(),
+		Identity:      id,
+		Kbucket:       bucket,
+		Seeds:         conf.Seeds,
+		Network:       conf.Network,
+		Plaintext:     conf.Plaintext,
+		DisjointPaths: conf.DisjointPaths,
+		Difficulty:    conf.Difficulty,
 	}
 	srv := server.NewServer(s)
 	srv.Start()
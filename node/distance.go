@@ -2,6 +2,7 @@ package node
 
 import (
 	"bytes"
+	"crypto/rand"
 	"kad/util"
 )
 
@@ -61,8 +62,29 @@ func (d Distance) Partion() int {
 				flag >>= 1
 				p--
 			}
+			break
 		}
 	}
 	p++
 	return p
 }
+
+//NewIDInPartion create a random nodeid whose distance to n falls in partion p
+func NewIDInPartion(n NodeID, p int) NodeID {
+	if p <= 0 || Length() < p {
+		return n
+	}
+	d := make([]byte, Length()/8)
+	rand.Read(d)
+	bit := p - 1
+	pos := len(d) - 1 - bit/8
+	for i := 0; i < pos; i++ {
+		d[i] = 0
+	}
+	mask := byte(1) << uint(bit%8)
+	d[pos] = d[pos]&(mask-1) | mask
+	nbyte, _ := n.ToByte()
+	r, _ := util.Xor(nbyte, d)
+	nid, _ := NewIDFromByte(r)
+	return nid
+}
@@ -23,3 +23,13 @@ func TestCompare(t *testing.T) {
 		t.Error("[distance.compare]distance compare failed.")
 	}
 }
+
+func TestNewIDInPartion(t *testing.T) {
+	n := NewNodeID()
+	for _, p := range []int{1, 7, 8, 9, 100, Length()} {
+		d, _ := CalDistance(n, NewIDInPartion(n, p))
+		if d.Partion() != p {
+			t.Error("[NewIDInPartion] partion ", d.Partion(), " != ", p)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package node
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+)
+
+//Identity the keypair of a node, the nodeid is derived from the public key
+type Identity struct {
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+	ID         NodeID
+}
+
+//NewIdentity generate a new keypair
+func NewIdentity() (*Identity, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newIdentity(priv), nil
+}
+
+//NewIdentityFromSeed restore a keypair from its private key seed
+func NewIdentityFromSeed(seed []byte) (*Identity, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid private key seed")
+	}
+	return newIdentity(ed25519.NewKeyFromSeed(seed)), nil
+}
+
+func newIdentity(priv ed25519.PrivateKey) *Identity {
+	pub := priv.Public().(ed25519.PublicKey)
+	return &Identity{
+		PrivateKey: priv,
+		PublicKey:  pub,
+		ID:         NewIDFromPublicKey(pub),
+	}
+}
+
+//Seed the private key seed to persist
+func (i *Identity) Seed() []byte {
+	return i.PrivateKey.Seed()
+}
+
+//Sign sign msg with the private key
+func (i *Identity) Sign(msg []byte) []byte {
+	return ed25519.Sign(i.PrivateKey, msg)
+}
+
+//Verify check that sig is a signature of msg by pub
+func Verify(pub ed25519.PublicKey, msg []byte, sig []byte) bool {
+	if len(pub) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(pub, msg, sig)
+}
+
+//NewIDFromPublicKey the nodeid owned by the holder of pub
+func NewIDFromPublicKey(pub ed25519.PublicKey) NodeID {
+	return NewIDFromKey(pub)
+}
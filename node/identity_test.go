@@ -0,0 +1,44 @@
+package node
+
+import (
+	"testing"
+)
+
+func TestIdentity(t *testing.T) {
+	id, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewIdentityFromSeed(id.Seed())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.ID.Equal(id.ID) {
+		t.Error("[NewIdentityFromSeed] restored id != id")
+	}
+	if !id.ID.Equal(NewIDFromPublicKey(id.PublicKey)) {
+		t.Error("[NewIdentity] id is not derived from the public key")
+	}
+	msg := []byte("message")
+	sig := id.Sign(msg)
+	if !Verify(id.PublicKey, msg, sig) {
+		t.Error("[Identity.Sign] signature not verified")
+	}
+	other, _ := NewIdentity()
+	if Verify(other.PublicKey, msg, sig) {
+		t.Error("[Verify] signature verified with another key")
+	}
+}
+
+func TestDifficulty(t *testing.T) {
+	id, err := NewIdentityWithDifficulty(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Difficulty(id.PublicKey) < 8 {
+		t.Error("[NewIdentityWithDifficulty] ", Difficulty(id.PublicKey), " leading zero bits, want 8")
+	}
+	if _, err := NewIdentityWithDifficulty(MaxDifficulty + 1); err == nil {
+		t.Error("[NewIdentityWithDifficulty] difficulty above the max accepted")
+	}
+}
@@ -1,5 +1,7 @@
 package node
 
+import "time"
+
 type (
 	//State state
 	State string
@@ -8,6 +10,12 @@ type (
 		ID    NodeID
 		Addr  string
 		State State
+		//LastSeen when the node was last added or refreshed in the kbucket
+		LastSeen time.Time
+		//RTT moving average of the round trip time of requests, 0 if unknown
+		RTT time.Duration
+		//Failures requests in a row which failed
+		Failures int
 	}
 )
 
@@ -1,45 +1,94 @@
 package node
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
 	"github.com/google/uuid"
 )
 
-//NodeID type nodeid
-type NodeID uuid.UUID
+//MaxLength the largest supported width of a nodeid in bits
+const MaxLength = 256
+
+//NodeID type nodeid, only the first Length() bits are used
+type NodeID [MaxLength / 8]byte
 
-//NewNodeID create a new node id
+//length the width of nodeids in bits
+var length = 160
+
+//SetLength set the width of nodeids in bits, it must be 128, 160 or 256 and
+//set before any nodeid is created
+func SetLength(bits int) error {
+	if bits != 128 && bits != 160 && bits != 256 {
+		return errors.New("nodeid length must be 128, 160 or 256")
+	}
+	length = bits
+	return nil
+}
+
+//NewNodeID create a new random node id
 func NewNodeID() NodeID {
-	return NodeID(uuid.New())
+	var nid NodeID
+	rand.Read(nid[:Length()/8])
+	return nid
 }
 
-//NewIDFromString create a new nodeid from string
+//NewIDFromString create a new nodeid from its hex form, a uuid is accepted for
+//compatibility and fills the first 128 bits
 func NewIDFromString(str string) (nid NodeID, err error) {
-	uid, err := uuid.Parse(str)
-	return NodeID(uid), err
+	if strings.Count(str, "-") == 4 {
+		uid, err := uuid.Parse(str)
+		if err != nil {
+			return nid, err
+		}
+		copy(nid[:], uid[:])
+		return nid, nil
+	}
+	b, err := hex.DecodeString(str)
+	if err != nil {
+		return nid, err
+	}
+	return NewIDFromByte(b)
 }
 
 //NewIDFromByte create a new nodeid from byte
 func NewIDFromByte(b []byte) (nid NodeID, err error) {
-	uid, err := uuid.FromBytes(b)
-	return NodeID(uid), err
+	if len(b) != Length()/8 {
+		return nid, errors.New("invalid nodeid length")
+	}
+	copy(nid[:], b)
+	return nid, nil
+}
+
+//NewIDFromKey create a nodeid at the position of a dht key in the id space
+func NewIDFromKey(key []byte) NodeID {
+	h := sha256.Sum256(key)
+	var nid NodeID
+	copy(nid[:Length()/8], h[:])
+	return nid
 }
 
 //String
 func (n NodeID) String() string {
-	return uuid.UUID(n).String()
+	return hex.EncodeToString(n[:Length()/8])
 }
 
 //Equal to compare two nodeid
 func (n NodeID) Equal(m NodeID) bool {
-	return n.String() == m.String()
+	return n == m
 }
 
 //ToByte convert into []byte
 func (n NodeID) ToByte() ([]byte, error) {
-	return uuid.UUID(n).MarshalBinary()
+	b := make([]byte, Length()/8)
+	copy(b, n[:])
+	return b, nil
 }
 
 //Length the length of nodeid
 func Length() int {
-	return 128
+	return length
 }
@@ -1 +1,49 @@
 package node
+
+import (
+	"testing"
+)
+
+func TestNewIDFromString(t *testing.T) {
+	nid := NewNodeID()
+	parsed, err := NewIDFromString(nid.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(nid) {
+		t.Error("[NewIDFromString] parsed id != id")
+	}
+	if len(nid.String()) != Length()/4 {
+		t.Error("[NodeID.String] hex length != Length()/4")
+	}
+	uid, err := NewIDFromString("80847077-4e11-4419-a4c6-8ad59f848bda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid.String()[:32] != "808470774e114419a4c68ad59f848bda" {
+		t.Error("[NewIDFromString] uuid does not fill the first 128 bits")
+	}
+}
+
+func TestSetLength(t *testing.T) {
+	defer SetLength(Length())
+	for _, bits := range []int{128, 160, 256} {
+		if err := SetLength(bits); err != nil {
+			t.Fatal(err)
+		}
+		a, b := NewNodeID(), NewNodeID()
+		d, err := CalDistance(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bits < d.Partion() {
+			t.Error("[Distance.Partion] partion out of range for ", bits, " bits")
+		}
+		if _, err := NewIDFromByte(make([]byte, bits/8)); err != nil {
+			t.Error("[NewIDFromByte] ", err)
+		}
+	}
+	if SetLength(100) == nil {
+		t.Error("[SetLength] invalid length accepted")
+	}
+}
@@ -0,0 +1,45 @@
+package node
+
+import (
+	"sort"
+	"time"
+)
+
+//ewmaWeight the weight of the history in the rtt average, as tcp's srtt
+const ewmaWeight = 8
+
+//EWMA fold the rtt sample into the average avg, 0 is an unknown rtt
+func EWMA(avg time.Duration, sample time.Duration) time.Duration {
+	if sample <= 0 {
+		return avg
+	}
+	if avg <= 0 {
+		return sample
+	}
+	return avg + (sample-avg)/ewmaWeight
+}
+
+//SortByProximity order ns by the partion of their distance to target, nodes
+//in the same partion are about as close, so the ones with a lower rtt go
+//first, the ones with an unknown rtt last
+func SortByProximity(ns []Node, target NodeID) {
+	parts := make(map[NodeID]int, len(ns))
+	for _, n := range ns {
+		d, err := CalDistance(n.ID, target)
+		if err != nil {
+			continue
+		}
+		parts[n.ID] = d.Partion()
+	}
+	sort.SliceStable(ns, func(i, j int) bool {
+		pi, pj := parts[ns[i].ID], parts[ns[j].ID]
+		if pi != pj {
+			return pi < pj
+		}
+		ri, rj := ns[i].RTT, ns[j].RTT
+		if ri == 0 || rj == 0 {
+			return ri != 0
+		}
+		return ri < rj
+	})
+}
@@ -0,0 +1,34 @@
+package node
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEWMA(t *testing.T) {
+	if EWMA(0, 80*time.Millisecond) != 80*time.Millisecond {
+		t.Error("[EWMA] the first sample is not the average")
+	}
+	if EWMA(80*time.Millisecond, 0) != 80*time.Millisecond {
+		t.Error("[EWMA] an unknown sample changed the average")
+	}
+	if EWMA(80*time.Millisecond, 160*time.Millisecond) != 90*time.Millisecond {
+		t.Error("[EWMA] 80ms then 160ms != 90ms")
+	}
+}
+
+func TestSortByProximity(t *testing.T) {
+	target := NewNodeID()
+	far := Node{ID: NewIDInPartion(target, Length()), Addr: "far", RTT: time.Millisecond}
+	slow := Node{ID: NewIDInPartion(target, 10), Addr: "slow", RTT: 100 * time.Millisecond}
+	fast := Node{ID: NewIDInPartion(target, 10), Addr: "fast", RTT: 10 * time.Millisecond}
+	unknown := Node{ID: NewIDInPartion(target, 10), Addr: "unknown"}
+	ns := []Node{far, unknown, slow, fast}
+	SortByProximity(ns, target)
+	want := []string{"fast", "slow", "unknown", "far"}
+	for i, n := range ns {
+		if n.Addr != want[i] {
+			t.Error("[SortByProximity] position ", i, " is ", n.Addr, ", want ", want[i])
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package node
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+)
+
+//MaxDifficulty the hardest puzzle a node may ask for, solving it takes
+//about 2^MaxDifficulty keypairs
+const MaxDifficulty = 32
+
+//Difficulty the number of leading zero bits of H(H(pub)), the static puzzle
+//of S/Kademlia, so a nodeid costs about 2^difficulty keypairs
+func Difficulty(pub ed25519.PublicKey) int {
+	h := sha256.Sum256(pub)
+	h = sha256.Sum256(h[:])
+	zeros := 0
+	for _, b := range h {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
+
+//NewIdentityWithDifficulty generate keypairs until one solves the puzzle of
+//difficulty c
+func NewIdentityWithDifficulty(c int) (*Identity, error) {
+	if c < 0 || MaxDifficulty < c {
+		return nil, errors.New("invalid puzzle difficulty")
+	}
+	for {
+		id, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		if c <= Difficulty(id.PublicKey) {
+			return id, nil
+		}
+	}
+}
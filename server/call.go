@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"kad/node"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+var (
+	//ErrTimeout the response did not arrive in time
+	ErrTimeout = errors.New("request timeout")
+	//ErrPeerClosed the connection closed before the response arrived
+	ErrPeerClosed = errors.New("peer closed")
+)
+
+type pending struct {
+	peer *Peer
+	resp chan *Message
+}
+
+//addPending register a call under a random request id, so a reply can not be
+//forged by guessing the next id
+func (s *Server) addPending(pd pending) (uint32, error) {
+	var b [4]byte
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		id := binary.LittleEndian.Uint32(b[:])
+		if _, ok := s.pending[id]; id != 0 && !ok {
+			s.pending[id] = pd
+			return id, nil
+		}
+	}
+}
+
+//Call send msg to p and wait for the response carrying the same request id,
+//the call is bounded by ctx or by the default timeout if ctx has no deadline
+func (s *Server) Call(ctx context.Context, p *Peer, msg *Message) (*Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, outtime)
+		defer cancel()
+	}
+	if msg.code != CodeMap[MSGPing] {
+		p.touch()
+	}
+	ch := make(chan *Message, 1)
+	id, err := s.addPending(pending{
+		peer: p,
+		resp: ch,
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg.id = id
+	defer func() {
+		s.pmu.Lock()
+		delete(s.pending, id)
+		s.pmu.Unlock()
+	}()
+	if err := p.Write(msg); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-ch:
+		if resp == nil {
+			return nil, ErrPeerClosed
+		}
+		if resp.code == CodeMap[MSGError] {
+			return nil, decodeError(resp.data)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+//CallAddr call the node at addr on the rpc transport, falling back to the
+//stream transport when msg does not fit in a datagram
+func (s *Server) CallAddr(ctx context.Context, addr string, msg *Message) (*Message, error) {
+	p, err := s.connect(addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.Call(ctx, p, msg)
+	if err != ErrTooLarge {
+		return resp, err
+	}
+	p, err = s.connectStream(addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.Call(ctx, p, msg)
+}
+
+//CallNode call n like CallAddr, pinging it first if it was never pinged,
+//failing if another nodeid answers at its address, the rtt of the call or
+//its failure is recorded in the kbucket
+func (s *Server) CallNode(ctx context.Context, n node.Node, msg *Message) (*Message, error) {
+	start := time.Now()
+	resp, err := s.callNode(ctx, n, msg)
+	if _, remote := err.(*RemoteError); err != nil && !remote {
+		if err != context.Canceled && err != ErrServerClosed {
+			s.config.Kbucket.Failed(n.ID)
+		}
+		return nil, err
+	}
+	n.RTT = time.Since(start)
+	n.Failures = 0
+	s.config.Kbucket.AddNode(n)
+	return resp, err
+}
+
+func (s *Server) callNode(ctx context.Context, n node.Node, msg *Message) (*Message, error) {
+	p, err := s.connect(n.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := bound(p, n.ID); err != nil {
+		return nil, err
+	}
+	if err := s.greet(ctx, p, n.ID); err != nil {
+		return nil, err
+	}
+	resp, err := s.Call(ctx, p, msg)
+	if err != ErrTooLarge {
+		return resp, err
+	}
+	p, err = s.connectStream(n.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := bound(p, n.ID); err != nil {
+		return nil, err
+	}
+	return s.Call(ctx, p, msg)
+}
+
+//resolve hand a response to the call waiting for it
+func (s *Server) resolve(p *Peer, m *Message) bool {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	pd, ok := s.pending[m.id]
+	if !ok || pd.peer != p {
+		return false
+	}
+	delete(s.pending, m.id)
+	pd.resp <- m
+	return true
+}
+
+//failPending fail all calls waiting on p
+func (s *Server) failPending(p *Peer) {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	for id, pd := range s.pending {
+		if pd.peer == p {
+			delete(s.pending, id)
+			close(pd.resp)
+		}
+	}
+}
+
+//reply send a response to the request req
+func (s *Server) reply(p *Peer, req *Message, mtype MessageType, data []byte) error {
+	msg := NewMessage(MAGIC, mtype, data)
+	msg.id = req.id
+	return p.Write(msg)
+}
+
+func (s *Server) handleResponse(p *Peer, m *Message) error {
+	if !s.resolve(p, m) {
+		golog.Warn("[server.handleresponse] unexpected response ", m.code, " id ", m.id, " from ", p.addr)
+	}
+	return nil
+}
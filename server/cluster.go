@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"kad/kbucket"
+	"kad/node"
+
+	"github.com/kataras/golog"
+)
+
+//Cluster servers in one process sharing a MemNetwork, for tests
+type Cluster struct {
+	Network *MemNetwork
+	Servers []*Server
+}
+
+//NewCluster start n servers on network, every server after the first one
+//pings the first one and looks itself up to fill its kbucket
+func NewCluster(n int, network *MemNetwork) *Cluster {
+	c := &Cluster{
+		Network: network,
+		Servers: make([]*Server, 0, n),
+	}
+	for i := 0; i < n; i++ {
+		c.Servers = append(c.Servers, c.start(i))
+	}
+	for _, s := range c.Servers[1:] {
+		c.bootstrap(s, c.Servers[0].config.Addr)
+	}
+	return c
+}
+
+func (c *Cluster) start(i int) *Server {
+	id, err := node.NewIdentity()
+	if err != nil {
+		golog.Fatal(err)
+	}
+	n := &node.Node{
+		ID:   id.ID,
+		Addr: fmt.Sprintf("10.%d.%d.1:15200", i/256, i%256),
+	}
+	s := NewServer(Config{
+		Addr:         n.Addr,
+		Identity:     id,
+		Kbucket:      kbucket.New(n),
+		NewTransport: c.Network.Transport,
+	})
+	go s.Start()
+	<-s.tran.(*MemTransport).Ready()
+	return s
+}
+
+func (c *Cluster) bootstrap(s *Server, seed string) {
+	if err := s.Bootstrap(context.Background(), []string{seed}); err != nil {
+		golog.Warn("[cluster.bootstrap] ", err)
+	}
+}
+
+//Close shut down every server
+func (c *Cluster) Close() {
+	for _, s := range c.Servers {
+		s.Shutdown()
+	}
+}
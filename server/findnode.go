@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"kad/node"
+
+	"github.com/kataras/golog"
+)
+
+const (
+	maxNodes   = 256
+	maxAddrLen = 256
+)
+
+func encodeID(w io.Writer, nid node.NodeID) error {
+	b, err := nid.ToByte()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func decodeID(r io.Reader) (node.NodeID, error) {
+	b := make([]byte, node.Length()/8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return node.NodeID{}, err
+	}
+	return node.NewIDFromByte(b)
+}
+
+func encodeNodes(w io.Writer, ns []node.Node) error {
+	count := uint32(len(ns))
+	if err := binary.Write(w, binary.LittleEndian, &count); err != nil {
+		return err
+	}
+	for _, n := range ns {
+		if err := encodeID(w, n.ID); err != nil {
+			return err
+		}
+		if maxAddrLen < len(n.Addr) {
+			return errors.New("address too long")
+		}
+		alen := uint16(len(n.Addr))
+		if err := binary.Write(w, binary.LittleEndian, &alen); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, n.Addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeNodes(r io.Reader) ([]node.Node, error) {
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	if maxNodes < count {
+		return nil, errors.New("too many nodes")
+	}
+	ns := make([]node.Node, 0, count)
+	for i := uint32(0); i < count; i++ {
+		nid, err := decodeID(r)
+		if err != nil {
+			return nil, err
+		}
+		var alen uint16
+		if err := binary.Read(r, binary.LittleEndian, &alen); err != nil {
+			return nil, err
+		}
+		if maxAddrLen < alen {
+			return nil, errors.New("address too long")
+		}
+		addr := make([]byte, alen)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return nil, err
+		}
+		ns = append(ns, node.Node{
+			ID:   nid,
+			Addr: string(addr),
+		})
+	}
+	return ns, nil
+}
+
+func (s *Server) handleFindNode(p *Peer, m *Message) error {
+	target, err := decodeID(bytes.NewReader(m.data))
+	if err != nil {
+		golog.Error("[server.handlefindnode] ", err)
+		return err
+	}
+	ns, err := s.config.Kbucket.FindN(target, s.config.Kbucket.K())
+	if err != nil {
+		return err
+	}
+	golog.Debug("[server.handlefindnode] find node ", target.String(), " for ", p.addr)
+	return s.sendNodes(p, m, ns)
+}
+
+func (s *Server) sendNodes(p *Peer, req *Message, ns []node.Node) error {
+	buf := new(bytes.Buffer)
+	if err := encodeNodes(buf, ns); err != nil {
+		return err
+	}
+	return s.reply(p, req, MSGNodes, buf.Bytes())
+}
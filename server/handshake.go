@@ -0,0 +1,538 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"kad/node"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+const (
+	nonceSize = 16
+	//pingWindow how far the timestamp of a ping may be from the local clock
+	pingWindow = time.Minute
+	//reachWindow how long an answer at an advertised address is trusted
+	reachWindow = 10 * time.Minute
+)
+
+var (
+	pingDomain = []byte("kad ping")
+	pongDomain = []byte("kad pong")
+)
+
+type (
+	//ping the pinger proves its key by signing a fresh nonce and timestamp,
+	//with its protocol version, capabilities, the address it advertises and
+	//the puzzle difficulty it asks of nodeids
+	ping struct {
+		pub        ed25519.PublicKey
+		nonce      []byte
+		ts         int64
+		version    uint16
+		caps       Capability
+		addr       string
+		difficulty uint8
+		sig        []byte
+	}
+	//pong the ponger proves its key by signing the nonce of the ping, with
+	//its protocol version, capabilities and puzzle difficulty
+	pong struct {
+		pub        ed25519.PublicKey
+		version    uint16
+		caps       Capability
+		difficulty uint8
+		sig        []byte
+	}
+	//nonces recently seen ping nonces, to reject replayed pings
+	nonces struct {
+		seen map[string]time.Time
+		mu   sync.Mutex
+	}
+	//reach contacts whose advertised address answered a ping recently, and
+	//the ones being checked
+	reach struct {
+		ok       map[string]time.Time
+		checking map[string]bool
+		mu       sync.Mutex
+	}
+)
+
+func newNonces() *nonces {
+	return &nonces{
+		seen: make(map[string]time.Time),
+	}
+}
+
+//add record nonce, false if it was already seen within the ping window
+func (n *nonces) add(nonce []byte, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for k, t := range n.seen {
+		if 2*pingWindow < now.Sub(t) {
+			delete(n.seen, k)
+		}
+	}
+	key := string(nonce)
+	if _, ok := n.seen[key]; ok {
+		return false
+	}
+	n.seen[key] = now
+	return true
+}
+
+func newReach() *reach {
+	return &reach{
+		ok:       make(map[string]time.Time),
+		checking: make(map[string]bool),
+	}
+}
+
+func reachKey(n node.Node) string {
+	return n.ID.String() + "@" + n.Addr
+}
+
+//valid whether n answered at its address within the reach window
+func (r *reach) valid(n node.Node, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.ok[reachKey(n)]
+	return ok && now.Sub(t) < reachWindow
+}
+
+//add record that n answered at its address
+func (r *reach) add(n node.Node, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, t := range r.ok {
+		if reachWindow < now.Sub(t) {
+			delete(r.ok, k)
+		}
+	}
+	key := reachKey(n)
+	r.ok[key] = now
+	delete(r.checking, key)
+}
+
+//check mark n as being checked, false if it already is
+func (r *reach) check(n node.Node) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := reachKey(n)
+	if r.checking[key] {
+		return false
+	}
+	r.checking[key] = true
+	return true
+}
+
+//fail forget the check of n
+func (r *reach) fail(n node.Node) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.checking, reachKey(n))
+}
+
+func (pi *ping) signed() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(pingDomain)
+	buf.Write(pi.pub)
+	buf.Write(pi.nonce)
+	binary.Write(buf, binary.LittleEndian, pi.ts)
+	binary.Write(buf, binary.LittleEndian, pi.version)
+	binary.Write(buf, binary.LittleEndian, pi.caps)
+	buf.WriteString(pi.addr)
+	if difficultyVersion <= pi.version {
+		buf.WriteByte(pi.difficulty)
+	}
+	return buf.Bytes()
+}
+
+func (po *pong) signed(nonce []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(pongDomain)
+	buf.Write(po.pub)
+	buf.Write(nonce)
+	binary.Write(buf, binary.LittleEndian, po.version)
+	binary.Write(buf, binary.LittleEndian, po.caps)
+	if difficultyVersion <= po.version {
+		buf.WriteByte(po.difficulty)
+	}
+	return buf.Bytes()
+}
+
+func (pi *ping) encode() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(pi.pub)
+	buf.Write(pi.nonce)
+	binary.Write(buf, binary.LittleEndian, pi.ts)
+	binary.Write(buf, binary.LittleEndian, pi.version)
+	binary.Write(buf, binary.LittleEndian, pi.caps)
+	binary.Write(buf, binary.LittleEndian, uint16(len(pi.addr)))
+	buf.WriteString(pi.addr)
+	if difficultyVersion <= pi.version {
+		buf.WriteByte(pi.difficulty)
+	}
+	buf.Write(pi.sig)
+	return buf.Bytes()
+}
+
+func decodePing(data []byte) (*ping, error) {
+	r := bytes.NewReader(data)
+	pi := &ping{
+		pub:   make([]byte, ed25519.PublicKeySize),
+		nonce: make([]byte, nonceSize),
+		sig:   make([]byte, ed25519.SignatureSize),
+	}
+	if _, err := io.ReadFull(r, pi.pub); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, pi.nonce); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &pi.ts); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &pi.version); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &pi.caps); err != nil {
+		return nil, err
+	}
+	var alen uint16
+	if err := binary.Read(r, binary.LittleEndian, &alen); err != nil {
+		return nil, err
+	}
+	if maxAddrLen < alen {
+		return nil, errors.New("address too long")
+	}
+	addr := make([]byte, alen)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, err
+	}
+	pi.addr = string(addr)
+	if difficultyVersion <= pi.version {
+		var err error
+		if pi.difficulty, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := io.ReadFull(r, pi.sig); err != nil {
+		return nil, err
+	}
+	return pi, nil
+}
+
+func (po *pong) encode() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(po.pub)
+	binary.Write(buf, binary.LittleEndian, po.version)
+	binary.Write(buf, binary.LittleEndian, po.caps)
+	if difficultyVersion <= po.version {
+		buf.WriteByte(po.difficulty)
+	}
+	buf.Write(po.sig)
+	return buf.Bytes()
+}
+
+func decodePong(data []byte) (*pong, error) {
+	r := bytes.NewReader(data)
+	po := &pong{
+		pub: make([]byte, ed25519.PublicKeySize),
+		sig: make([]byte, ed25519.SignatureSize),
+	}
+	if _, err := io.ReadFull(r, po.pub); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &po.version); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &po.caps); err != nil {
+		return nil, err
+	}
+	if difficultyVersion <= po.version {
+		var err error
+		if po.difficulty, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := io.ReadFull(r, po.sig); err != nil {
+		return nil, err
+	}
+	return po, nil
+}
+
+//bound check that nid is the one authenticated by the transport of p, if any
+func bound(p *Peer, nid node.NodeID) error {
+	id, verified := p.ID()
+	if verified && !id.Equal(nid) {
+		return errors.New("nodeid does not match the session key")
+	}
+	return nil
+}
+
+//verifyPing check the signature, freshness and uniqueness of a ping
+func (s *Server) verifyPing(pi *ping) error {
+	if !node.Verify(pi.pub, pi.signed(), pi.sig) {
+		return errors.New("invalid ping signature")
+	}
+	now := time.Now()
+	ts := time.Unix(pi.ts, 0)
+	if pingWindow < now.Sub(ts) || pingWindow < ts.Sub(now) {
+		return errors.New("stale ping")
+	}
+	if !s.nonces.add(pi.nonce, now) {
+		return errors.New("replayed ping")
+	}
+	return nil
+}
+
+func (s *Server) handlePing(p *Peer, m *Message) error {
+	pi, err := decodePing(m.data)
+	if err != nil {
+		golog.Error("[handleping] ", err)
+		return err
+	}
+	if err := s.verifyPing(pi); err != nil {
+		golog.Warn("[server.handleping] reject ping from ", p.addr, ": ", err)
+		return err
+	}
+	if pi.version < minVersion {
+		golog.Warn("[server.handleping] reject ping from ", p.addr, ": version ", pi.version)
+		return s.sendError(p, m, "unsupported protocol version")
+	}
+	if node.Difficulty(pi.pub) < s.config.Difficulty {
+		golog.Warn("[server.handleping] reject ping from ", p.addr, ": puzzle not solved")
+		return s.sendError(p, m, "nodeid does not solve the puzzle of difficulty "+strconv.Itoa(s.config.Difficulty))
+	}
+	if node.Difficulty(s.config.Identity.PublicKey) < int(pi.difficulty) {
+		golog.Warn("[server.handleping] ", p.addr, " asks for a puzzle of difficulty ", pi.difficulty, " this nodeid does not solve")
+	}
+	nid := node.NewIDFromPublicKey(pi.pub)
+	if err := bound(p, nid); err != nil {
+		return err
+	}
+	p.SetID(nid)
+	p.setProtocol(pi.version, pi.caps)
+	addr, err := contactAddr(pi.addr, p.addr)
+	if err != nil {
+		golog.Warn("[server.handleping] reject ping from ", p.addr, ": ", err)
+		return err
+	}
+	p.setContact(addr)
+	n := node.Node{
+		ID:   nid,
+		Addr: addr,
+	}
+	golog.Info("[server.handleping] recieve ping from node: ", addr, nid.String())
+	if addr == p.addr && p.Dialed() || s.reach.valid(n, time.Now()) {
+		s.config.Kbucket.AddNode(n)
+	} else if s.reach.check(n) {
+		go s.checkReach(n)
+	}
+	return s.sendPong(p, m, pi.nonce)
+}
+
+//verified the node of p if its address is the dialable one it is seen at or
+//answered a ping recently, an address is otherwise checked in background, so
+//a node can not claim the address of another one nor the ephemeral source
+//port of its connection
+func (s *Server) verified(p *Peer) (node.Node, bool) {
+	n, ok := p.Node()
+	if !ok {
+		return node.Node{}, false
+	}
+	if n.Addr == p.addr && p.Dialed() || s.reach.valid(n, time.Now()) {
+		return n, true
+	}
+	if s.reach.check(n) {
+		go s.checkReach(n)
+	}
+	return node.Node{}, false
+}
+
+//contactAddr the address to record for a node advertising adv and seen at
+//observed, an advertised address without a host takes the observed host, no
+//address at all takes the observed one, which handlePing only trusts on a
+//dialed peer
+func contactAddr(adv string, observed string) (string, error) {
+	if adv == "" {
+		return observed, nil
+	}
+	host, port, err := net.SplitHostPort(adv)
+	if err != nil {
+		return "", err
+	}
+	if port == "" || port == "0" {
+		return "", errors.New("no port in advertised address")
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host, _, err = net.SplitHostPort(observed)
+		if err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+//dialable whether addr has a host and a port other nodes can dial, an
+//advertised address without a host is only filled in by the nodes it reaches
+func dialable(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || port == "" || port == "0" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsUnspecified()
+}
+
+//checkReach ping n at the address it advertised, the pong adds it to the
+//kbucket, so a node is never recorded at an address it cannot be dialed on
+func (s *Server) checkReach(n node.Node) {
+	p, err := s.connect(n.Addr)
+	if err != nil {
+		golog.Warn("[server.checkreach] dial ", n.Addr, " ", err)
+		s.reach.fail(n)
+		return
+	}
+	nid, err := s.ping(context.Background(), p)
+	if err != nil || !nid.Equal(n.ID) {
+		golog.Warn("[server.checkreach] ", n.Addr, " did not answer for ", n.ID.String())
+		s.reach.fail(n)
+	}
+}
+
+func (s *Server) sendPong(p *Peer, req *Message, nonce []byte) error {
+	id := s.config.Identity
+	po := &pong{
+		pub:        id.PublicKey,
+		version:    ProtocolVersion,
+		caps:       s.capabilities(),
+		difficulty: uint8(s.config.Difficulty),
+	}
+	po.sig = id.Sign(po.signed(nonce))
+	return s.reply(p, req, MSGPong, po.encode())
+}
+
+//ping send a signed ping to p and add it to the kbucket once its pong proves
+//it owns the key of its nodeid
+func (s *Server) ping(ctx context.Context, p *Peer) (node.NodeID, error) {
+	id := s.config.Identity
+	pi := &ping{
+		pub:        id.PublicKey,
+		nonce:      make([]byte, nonceSize),
+		ts:         time.Now().Unix(),
+		version:    ProtocolVersion,
+		caps:       s.capabilities(),
+		addr:       s.config.Advertise,
+		difficulty: uint8(s.config.Difficulty),
+	}
+	if _, err := rand.Read(pi.nonce); err != nil {
+		return node.NodeID{}, err
+	}
+	pi.sig = id.Sign(pi.signed())
+	start := time.Now()
+	resp, err := s.Call(ctx, p, NewMessage(MAGIC, MSGPing, pi.encode()))
+	if err != nil {
+		return node.NodeID{}, err
+	}
+	rtt := time.Since(start)
+	po, err := decodePong(resp.data)
+	if err != nil {
+		return node.NodeID{}, err
+	}
+	if !node.Verify(po.pub, po.signed(pi.nonce), po.sig) {
+		return node.NodeID{}, errors.New("invalid pong signature")
+	}
+	if po.version < minVersion {
+		return node.NodeID{}, errors.New("unsupported protocol version of pong")
+	}
+	if node.Difficulty(po.pub) < s.config.Difficulty {
+		return node.NodeID{}, errors.New("nodeid of pong does not solve the puzzle")
+	}
+	if node.Difficulty(id.PublicKey) < int(po.difficulty) {
+		golog.Warn("[server.ping] ", p.addr, " asks for a puzzle of difficulty ", po.difficulty, " this nodeid does not solve")
+	}
+	nid := node.NewIDFromPublicKey(po.pub)
+	if err := bound(p, nid); err != nil {
+		return node.NodeID{}, err
+	}
+	p.SetID(nid)
+	p.setProtocol(po.version, po.caps)
+	p.setContact(p.addr)
+	p.setGreeted()
+	n := node.Node{
+		ID:   nid,
+		Addr: p.addr,
+		RTT:  rtt,
+	}
+	golog.Info("[server.ping] recieve pong from node: ", p.addr, nid.String())
+	s.reach.add(n, time.Now())
+	s.config.Kbucket.AddNode(n)
+	return nid, nil
+}
+
+//greet ping p before the first request to it, so it adds this node to its
+//kbucket and proves it owns nid
+func (s *Server) greet(ctx context.Context, p *Peer, nid node.NodeID) error {
+	if p.Greeted() {
+		return nil
+	}
+	id, err := s.ping(ctx, p)
+	if err != nil {
+		return err
+	}
+	if !id.Equal(nid) {
+		return errors.New("nodeid does not match the pong key")
+	}
+	return nil
+}
+
+//keepalive ping an idle peer this node dialed whose node is in the kbucket,
+//after maxMissed unanswered pings in a row its node is removed from the
+//kbucket and the peer closed, a peer whose node is not in the kbucket is
+//closed once it carried no request for peerOut, the peers which dialed this
+//node keep their connections alive themselves
+func (s *Server) keepalive(p *Peer) {
+	if !s.known(p) {
+		if peerOut <= p.idle() {
+			p.Disconnect(errors.New("idle peer out of the kbucket"))
+		}
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), outtime)
+	defer cancel()
+	_, err := s.ping(ctx, p)
+	if err == nil {
+		p.missed = 0
+		return
+	}
+	p.missed++
+	golog.Warn("[server.keepalive] ", p.addr, " missed ", p.missed, " pings: ", err)
+	if p.missed < maxMissed {
+		return
+	}
+	if id, _ := p.ID(); !id.Equal(node.NodeID{}) {
+		s.config.Kbucket.RemoveNode(node.Node{ID: id, Addr: p.addr})
+	}
+	p.Disconnect(errors.New("keepalive pings unanswered"))
+}
+
+//known whether the node of p is in the kbucket
+func (s *Server) known(p *Peer) bool {
+	id, _ := p.ID()
+	if id.Equal(node.NodeID{}) {
+		return false
+	}
+	n, err := s.config.Kbucket.FindOne(id)
+	return err == nil && n.ID.Equal(id)
+}
@@ -0,0 +1,367 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"kad/node"
+	"kad/store"
+	"sort"
+	"sync"
+
+	"github.com/kataras/golog"
+)
+
+type (
+	contact struct {
+		node      node.Node
+		queried   bool
+		responded bool
+	}
+	//lookup state of an iterative lookup, one path of a disjoint lookup
+	lookup struct {
+		server    *Server
+		target    node.NodeID
+		k         int
+		alpha     int
+		shortlist []*contact
+		seen      map[string]bool
+		path      int
+		claims    *claims
+	}
+	//claims the contacts queried by each path of a disjoint lookup
+	claims struct {
+		by map[node.NodeID]int
+		mu sync.Mutex
+	}
+	//reply the answer of a FIND_NODE, FIND_VALUE or GET_PROVIDERS query
+	reply struct {
+		nodes     []node.Node
+		value     []byte
+		found     bool
+		stream    bool
+		providers []node.Node
+		//record the mutable record of a FIND_VALUE reply
+		record *store.Record
+		//path the path of the lookup which got the reply
+		path int
+	}
+	result struct {
+		c   *contact
+		r   reply
+		err error
+	}
+)
+
+//FindNode iteratively look up the k closest nodes to target in the network
+func (s *Server) FindNode(ctx context.Context, target node.NodeID) ([]node.Node, error) {
+	ns, _, err := s.iterate(ctx, target, MSGFindNode)
+	return ns, err
+}
+
+//iterate run an iterative lookup towards target, a MSGFindValue lookup stops
+//as soon as one of the contacts returns the value
+func (s *Server) iterate(ctx context.Context, target node.NodeID, mtype MessageType) ([]node.Node, *reply, error) {
+	var found *reply
+	ns, err := s.walk(ctx, target, mtype, func(r reply) bool {
+		if r.found && found == nil {
+			found = &r
+		}
+		return found != nil
+	})
+	return ns, found, err
+}
+
+//walk run an iterative lookup towards target, visit sees every reply and
+//ends the lookup after the current round by returning true, with
+//DisjointPaths set it runs that many disjoint lookups and visit ends the
+//path of the reply
+func (s *Server) walk(ctx context.Context, target node.NodeID, mtype MessageType, visit func(r reply) bool) ([]node.Node, error) {
+	k := s.config.Kbucket.K()
+	s.config.Kbucket.Touch(target)
+	seeds, err := s.config.Kbucket.FindN(target, k)
+	if err != nil {
+		return []node.Node{}, err
+	}
+	d := s.paths()
+	if d == 1 {
+		l := s.newLookup(target, 0, nil)
+		l.merge(seeds)
+		return l.run(ctx, mtype, visit)
+	}
+	return s.disjoint(ctx, target, mtype, seeds, d, visit)
+}
+
+//paths the number of disjoint paths of a lookup
+func (s *Server) paths() int {
+	if s.config.DisjointPaths < 1 {
+		return 1
+	}
+	return s.config.DisjointPaths
+}
+
+func (s *Server) newLookup(target node.NodeID, path int, cl *claims) *lookup {
+	return &lookup{
+		server: s,
+		target: target,
+		k:      s.config.Kbucket.K(),
+		alpha:  s.config.Kbucket.Alpha(),
+		seen:   make(map[string]bool),
+		path:   path,
+		claims: cl,
+	}
+}
+
+//disjoint run d lookups in parallel which never query the same contact, the
+//seeds are dealt between them, the result is the k closest nodes which a
+//majority of the paths heard of, so a node on one path can not steer it
+func (s *Server) disjoint(ctx context.Context, target node.NodeID, mtype MessageType, seeds []node.Node, d int, visit func(r reply) bool) ([]node.Node, error) {
+	cl := &claims{
+		by: make(map[node.NodeID]int),
+	}
+	var mu sync.Mutex
+	serial := func(r reply) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return visit(r)
+	}
+	paths := make([]*lookup, d)
+	for i := range paths {
+		paths[i] = s.newLookup(target, i, cl)
+	}
+	for i, n := range seeds {
+		paths[i%d].merge([]node.Node{n})
+	}
+	errs := make(chan error, d)
+	for _, l := range paths {
+		go func(l *lookup) {
+			_, err := l.run(ctx, mtype, serial)
+			errs <- err
+		}(l)
+	}
+	var err error
+	for range paths {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return agreed(paths, target), err
+}
+
+//agreed the k closest nodes found by the paths which a majority of them
+//heard of
+func agreed(paths []*lookup, target node.NodeID) []node.Node {
+	votes := map[string]int{}
+	for _, l := range paths {
+		for key := range l.seen {
+			votes[key]++
+		}
+	}
+	ns := []node.Node{}
+	added := map[string]bool{}
+	for _, l := range paths {
+		for _, n := range l.closest() {
+			key := n.ID.String()
+			if added[key] || votes[key] <= len(paths)/2 {
+				continue
+			}
+			added[key] = true
+			ns = append(ns, n)
+		}
+	}
+	sort.SliceStable(ns, func(i, j int) bool {
+		di, _ := node.CalDistance(ns[i].ID, target)
+		dj, _ := node.CalDistance(ns[j].ID, target)
+		return di.Compare(dj) < 0
+	})
+	if k := paths[0].k; k < len(ns) {
+		ns = ns[:k]
+	}
+	return ns
+}
+
+//run query the contacts of the shortlist until the k closest ones answered
+//or visit returns true
+func (l *lookup) run(ctx context.Context, mtype MessageType, visit func(r reply) bool) ([]node.Node, error) {
+	s := l.server
+	for {
+		if err := ctx.Err(); err != nil {
+			return l.closest(), err
+		}
+		next := l.next()
+		if len(next) == 0 {
+			break
+		}
+		results := make(chan result, len(next))
+		for _, c := range next {
+			c.queried = true
+			go func(c *contact) {
+				qctx, cancel := context.WithTimeout(ctx, outtime)
+				defer cancel()
+				r, err := s.query(qctx, c.node, l.target, mtype)
+				results <- result{c: c, r: r, err: err}
+			}(c)
+		}
+		stop := false
+		for range next {
+			res := <-results
+			if res.err != nil {
+				golog.Warn("[server.walk] query ", res.c.node.Addr, " failed: ", res.err)
+				l.drop(res.c)
+				continue
+			}
+			res.c.responded = true
+			res.r.path = l.path
+			if visit(res.r) {
+				stop = true
+			}
+			l.merge(res.r.nodes)
+		}
+		if stop {
+			return l.closest(), nil
+		}
+	}
+	return l.closest(), nil
+}
+
+//claim reserve the contact nid for path, false if another path has it
+func (c *claims) claim(nid node.NodeID, path int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.by[nid]; ok {
+		return p == path
+	}
+	c.by[nid] = path
+	return true
+}
+
+//free whether path may still query nid
+func (c *claims) free(nid node.NodeID, path int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.by[nid]
+	return !ok || p == path
+}
+
+//next alpha contacts among the k closest which are not queried yet, the
+//ones with the lowest rtt among the about as close ones
+func (l *lookup) next() []*contact {
+	if l.claims != nil {
+		//the contacts of other paths are dropped, each one is queried once
+		kept := l.shortlist[:0]
+		for _, c := range l.shortlist {
+			if c.queried || l.claims.free(c.node.ID, l.path) {
+				kept = append(kept, c)
+			}
+		}
+		l.shortlist = kept
+	}
+	cands := []*contact{}
+	for i, c := range l.shortlist {
+		if l.k <= i {
+			break
+		}
+		if !c.queried {
+			cands = append(cands, c)
+		}
+	}
+	ns := make([]node.Node, len(cands))
+	byID := make(map[node.NodeID]*contact, len(cands))
+	for i, c := range cands {
+		ns[i] = c.node
+		byID[c.node.ID] = c
+	}
+	node.SortByProximity(ns, l.target)
+	res := []*contact{}
+	for _, n := range ns {
+		if l.alpha <= len(res) {
+			break
+		}
+		if l.claims != nil && !l.claims.claim(n.ID, l.path) {
+			l.drop(byID[n.ID])
+			continue
+		}
+		res = append(res, byID[n.ID])
+	}
+	return res
+}
+
+func (l *lookup) merge(ns []node.Node) {
+	for _, n := range ns {
+		if n.Addr == "" || n.ID.Equal(l.server.config.ID) {
+			continue
+		}
+		key := n.ID.String()
+		if l.seen[key] {
+			continue
+		}
+		l.seen[key] = true
+		l.shortlist = append(l.shortlist, &contact{node: n})
+	}
+	sort.SliceStable(l.shortlist, func(i, j int) bool {
+		di, _ := node.CalDistance(l.shortlist[i].node.ID, l.target)
+		dj, _ := node.CalDistance(l.shortlist[j].node.ID, l.target)
+		return di.Compare(dj) < 0
+	})
+}
+
+func (l *lookup) drop(c *contact) {
+	for i, v := range l.shortlist {
+		if v == c {
+			l.shortlist = append(l.shortlist[:i], l.shortlist[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *lookup) closest() []node.Node {
+	res := []node.Node{}
+	for _, c := range l.shortlist {
+		if l.k <= len(res) {
+			break
+		}
+		if c.responded {
+			res = append(res, c.node)
+		}
+	}
+	return res
+}
+
+//query send a FIND_NODE, FIND_VALUE or GET_PROVIDERS to n and wait for its reply
+func (s *Server) query(ctx context.Context, n node.Node, target node.NodeID, mtype MessageType) (reply, error) {
+	buf := new(bytes.Buffer)
+	if err := encodeID(buf, target); err != nil {
+		return reply{}, err
+	}
+	resp, err := s.CallNode(ctx, n, NewMessage(MAGIC, mtype, buf.Bytes()))
+	if err != nil {
+		return reply{}, err
+	}
+	if resp.code != CodeMap[ResponseOf[mtype]] {
+		return reply{}, errors.New("unexpected response")
+	}
+	if mtype == MSGGetProviders {
+		return decodeProviders(resp.data)
+	}
+	if mtype != MSGFindValue {
+		ns, err := decodeNodes(bytes.NewReader(resp.data))
+		return reply{nodes: ns}, err
+	}
+	rep, err := decodeValue(resp.data)
+	if err != nil || !rep.stream {
+		return rep, err
+	}
+	//the value does not fit in a datagram, ask again over the stream transport
+	p, err := s.connectStream(n.Addr)
+	if err != nil {
+		return reply{}, err
+	}
+	if err := bound(p, n.ID); err != nil {
+		return reply{}, err
+	}
+	resp, err = s.Call(ctx, p, NewMessage(MAGIC, mtype, buf.Bytes()))
+	if err != nil {
+		return reply{}, err
+	}
+	return decodeValue(resp.data)
+}
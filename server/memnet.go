@@ -0,0 +1,243 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//ErrRefused no transport listens on the address
+var ErrRefused = errors.New("connection refused")
+
+//firstPort the first ephemeral port given to a dialer
+const firstPort = 40000
+
+//MemNetwork an in-process network connecting MemTransports by address,
+//messages are delayed by latency and dropped with probability droprate
+type MemNetwork struct {
+	latency   time.Duration
+	droprate  float64
+	listeners map[string]*MemTransport
+	rand      *rand.Rand
+	//port the next ephemeral port, a dialer is seen from its host and a
+	//port it does not listen on, as with tcp
+	port int
+	mu   sync.Mutex
+}
+
+//MemTransport a transport over a MemNetwork
+type MemTransport struct {
+	network *MemNetwork
+	server  *Server
+	accept  chan *memConn
+	ready   chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+//memConn one end of an in-memory connection
+type memConn struct {
+	network *MemNetwork
+	raddr   string
+	in      chan []byte
+	remote  *memConn
+	buf     []byte
+	done    chan struct{}
+	once    *sync.Once
+}
+
+//NewMemNetwork create an in-memory network, seed makes the drops reproducible
+func NewMemNetwork(latency time.Duration, droprate float64, seed int64) *MemNetwork {
+	return &MemNetwork{
+		latency:   latency,
+		droprate:  droprate,
+		listeners: make(map[string]*MemTransport),
+		rand:      rand.New(rand.NewSource(seed)),
+		port:      firstPort,
+	}
+}
+
+//Transport create a transport of s on the network, to be used as Config.NewTransport
+func (n *MemNetwork) Transport(s *Server) Transport {
+	return &MemTransport{
+		network: n,
+		server:  s,
+		accept:  make(chan *memConn),
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+//SetLatency change the delay of every message
+func (n *MemNetwork) SetLatency(latency time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency = latency
+}
+
+//SetDropRate change the probability of a message being dropped
+func (n *MemNetwork) SetDropRate(droprate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.droprate = droprate
+}
+
+//fate decide whether a message is dropped and how long it is delayed
+func (n *MemNetwork) fate() (bool, time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if 0 < n.droprate && n.rand.Float64() < n.droprate {
+		return true, 0
+	}
+	return false, n.latency
+}
+
+//ephemeral the address a connection dialed from addr comes from
+func (n *MemNetwork) ephemeral(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	port := n.port
+	n.port++
+	if 65535 < n.port {
+		n.port = firstPort
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func (n *MemNetwork) listener(addr string) (*MemTransport, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	t, ok := n.listeners[addr]
+	return t, ok
+}
+
+//newMemPipe connect the addresses from and to, the first end is used by from
+func newMemPipe(n *MemNetwork, from string, to string) (*memConn, *memConn) {
+	done := make(chan struct{})
+	once := &sync.Once{}
+	a := &memConn{
+		network: n,
+		raddr:   to,
+		in:      make(chan []byte, 64),
+		done:    done,
+		once:    once,
+	}
+	b := &memConn{
+		network: n,
+		raddr:   from,
+		in:      make(chan []byte, 64),
+		done:    done,
+		once:    once,
+	}
+	a.remote = b
+	b.remote = a
+	return a, b
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	drop, latency := c.network.fate()
+	if drop {
+		return len(b), nil
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	deliver := func() {
+		select {
+		case c.remote.in <- data:
+		case <-c.done:
+		}
+	}
+	if latency <= 0 {
+		deliver()
+	} else {
+		time.AfterFunc(latency, deliver)
+	}
+	return len(b), nil
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	if len(c.buf) == 0 {
+		select {
+		case data := <-c.in:
+			c.buf = data
+		case <-c.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *memConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
+
+//Ready closed once the transport accepts connections
+func (t *MemTransport) Ready() <-chan struct{} {
+	return t.ready
+}
+
+func (t *MemTransport) Dial(addr string, ot time.Duration) (*Peer, error) {
+	l, ok := t.network.listener(addr)
+	if !ok {
+		return &Peer{}, ErrRefused
+	}
+	local, remote := newMemPipe(t.network, t.network.ephemeral(t.server.config.Addr), addr)
+	select {
+	case l.accept <- remote:
+	case <-l.done:
+		return &Peer{}, ErrRefused
+	case <-time.After(ot):
+		return &Peer{}, ErrTimeout
+	}
+	p := NewPeer(addr, local, 0)
+	p.setDialed()
+	p.setKeepalive(t.server.keepalive)
+	go t.server.handleConn(p, local)
+	return p, nil
+}
+
+func (t *MemTransport) Accept() {
+	addr := t.server.config.Addr
+	t.network.mu.Lock()
+	t.network.listeners[addr] = t
+	t.network.mu.Unlock()
+	close(t.ready)
+	for {
+		select {
+		case conn := <-t.accept:
+			p := NewPeer(conn.raddr, conn, 0)
+			go t.server.handleConn(p, conn)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *MemTransport) Close() {
+	t.once.Do(func() {
+		close(t.done)
+		t.network.mu.Lock()
+		if t.network.listeners[t.server.config.Addr] == t {
+			delete(t.network.listeners, t.server.config.Addr)
+		}
+		t.network.mu.Unlock()
+	})
+}
@@ -5,29 +5,104 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 )
 
 const (
-	MAGIC = 0x7596
+	//MAGIC the first word of a frame, it changes with the frame layout so a
+	//node never misreads the frames of another layout
+	MAGIC = 0x7597
+	//legacyMagic the frames without checksum
+	legacyMagic = 0x7596
+	//DefaultMaxFrame the largest payload Decode accepts
+	DefaultMaxFrame = 1 << 20
 )
 
+//ErrFrameTooLarge the length of a frame exceeds the limit
+var ErrFrameTooLarge = errors.New("frame too large")
+
+//ErrChecksum the checksum of a frame does not match its content
+var ErrChecksum = errors.New("checksum mismatch")
+
+//ErrLegacyFrame the frame has the layout without checksum of older nodes
+var ErrLegacyFrame = errors.New("frame layout without checksum, the peer must upgrade")
+
+//Message a frame on the wire, the checksum covers the header and the payload
 type Message struct {
-	magic  uint32
-	code   uint32
-	length uint32
-	data   []byte
+	magic    uint32
+	code     uint32
+	id       uint32
+	length   uint32
+	checksum uint32
+	data     []byte
 }
 type MessageType string
 
 const (
-	MSGPing MessageType = "ping"
-	MSGPong MessageType = "pong"
+	MSGPing      MessageType = "ping"
+	MSGPong      MessageType = "pong"
+	MSGFindNode  MessageType = "findnode"
+	MSGNodes     MessageType = "nodes"
+	MSGStore     MessageType = "store"
+	MSGStored    MessageType = "stored"
+	MSGFindValue MessageType = "findvalue"
+	MSGValue     MessageType = "value"
+	//MSGAddProvider announce the sender provides the content of a key
+	MSGAddProvider   MessageType = "addprovider"
+	MSGProviderAdded MessageType = "provideradded"
+	//MSGGetProviders ask for the providers of a key and the closest nodes
+	MSGGetProviders MessageType = "getproviders"
+	MSGProviders    MessageType = "providers"
+	//MSGStoreMutable store a record signed by its owner
+	MSGStoreMutable  MessageType = "storemutable"
+	MSGMutableStored MessageType = "mutablestored"
+	//MSGError the reply to a request which could not be handled
+	MSGError MessageType = "error"
+	//MSGReply the reply of a handler registered with Server.Handle
+	MSGReply MessageType = "reply"
 )
 
 var CodeMap = map[MessageType]uint32{
-	MSGPing: 0x00F1,
-	MSGPong: 0x01F1,
+	MSGPing:          0x00F1,
+	MSGPong:          0x01F1,
+	MSGFindNode:      0x00F2,
+	MSGNodes:         0x01F2,
+	MSGStore:         0x00F3,
+	MSGStored:        0x01F3,
+	MSGFindValue:     0x00F4,
+	MSGValue:         0x01F4,
+	MSGAddProvider:   0x00F5,
+	MSGProviderAdded: 0x01F5,
+	MSGGetProviders:  0x00F6,
+	MSGProviders:     0x01F6,
+	MSGStoreMutable:  0x00F7,
+	MSGMutableStored: 0x01F7,
+	MSGReply:         0x01FE,
+	MSGError:         0x01FF,
+}
+
+//ResponseOf the response type of each request type
+var ResponseOf = map[MessageType]MessageType{
+	MSGPing:         MSGPong,
+	MSGFindNode:     MSGNodes,
+	MSGStore:        MSGStored,
+	MSGFindValue:    MSGValue,
+	MSGAddProvider:  MSGProviderAdded,
+	MSGGetProviders: MSGProviders,
+	MSGStoreMutable: MSGMutableStored,
+}
+
+func isResponse(code uint32) bool {
+	if code == CodeMap[MSGError] || code == CodeMap[MSGReply] {
+		return true
+	}
+	for _, v := range ResponseOf {
+		if CodeMap[v] == code {
+			return true
+		}
+	}
+	return false
 }
 
 func NewMessage(magic uint32, mtype MessageType, data []byte) *Message {
@@ -39,37 +114,94 @@ func NewMessage(magic uint32, mtype MessageType, data []byte) *Message {
 	}
 }
 
+//Code the message code
+func (m *Message) Code() uint32 {
+	return m.code
+}
+
+//ID the request id, a response carries the id of its request
+func (m *Message) ID() uint32 {
+	return m.id
+}
+
+//Data the payload
+func (m *Message) Data() []byte {
+	return m.data
+}
+
+//sum the crc32 of the header and the payload
+func (m *Message) sum() uint32 {
+	var head [16]byte
+	binary.LittleEndian.PutUint32(head[0:], m.magic)
+	binary.LittleEndian.PutUint32(head[4:], m.code)
+	binary.LittleEndian.PutUint32(head[8:], m.id)
+	binary.LittleEndian.PutUint32(head[12:], m.length)
+	h := crc32.NewIEEE()
+	h.Write(head[:])
+	h.Write(m.data)
+	return h.Sum32()
+}
+
 func (m *Message) Encode(w io.Writer) error {
+	m.length = uint32(len(m.data))
+	m.checksum = m.sum()
 	if err := binary.Write(w, binary.LittleEndian, &m.magic); err != nil {
 		return err
 	}
 	if err := binary.Write(w, binary.LittleEndian, &m.code); err != nil {
 		return err
 	}
+	if err := binary.Write(w, binary.LittleEndian, &m.id); err != nil {
+		return err
+	}
 	if err := binary.Write(w, binary.LittleEndian, &m.length); err != nil {
 		return err
 	}
+	if err := binary.Write(w, binary.LittleEndian, &m.checksum); err != nil {
+		return err
+	}
 	if err := binary.Write(w, binary.LittleEndian, &m.data); err != nil {
 		return err
 	}
 	return nil
 }
+
+//Decode read a frame with a payload of at most DefaultMaxFrame bytes
 func (m *Message) Decode(r io.Reader) error {
+	if err := m.DecodeHeader(r, DefaultMaxFrame); err != nil {
+		return err
+	}
+	return m.DecodeData(r)
+}
+
+//DecodeHeader read the header of a frame, rejecting a payload longer than max
+//before anything is allocated for it
+func (m *Message) DecodeHeader(r io.Reader, max uint32) error {
 	if err := binary.Read(r, binary.LittleEndian, &m.magic); err != nil {
 		return err
 	}
+	if m.magic == legacyMagic {
+		return ErrLegacyFrame
+	}
 	if m.magic != MAGIC {
 		return errors.New("magic not match")
 	}
 	if err := binary.Read(r, binary.LittleEndian, &m.code); err != nil {
 		return err
 	}
+	if err := binary.Read(r, binary.LittleEndian, &m.id); err != nil {
+		return err
+	}
 	if err := binary.Read(r, binary.LittleEndian, &m.length); err != nil {
 		return err
 	}
-	return m.DecodeData(r)
+	if max < m.length {
+		return ErrFrameTooLarge
+	}
+	return binary.Read(r, binary.LittleEndian, &m.checksum)
 }
 
+//DecodeData read the payload announced by the header and verify the checksum
 func (m *Message) DecodeData(r io.Reader) error {
 	buf := new(bytes.Buffer)
 	n, err := io.CopyN(buf, r, int64(m.length))
@@ -80,5 +212,8 @@ func (m *Message) DecodeData(r io.Reader) error {
 		return fmt.Errorf("expected to read %d bytes, but got %d bytes", m.length, n)
 	}
 	m.data = buf.Bytes()
+	if m.sum() != m.checksum {
+		return ErrChecksum
+	}
 	return nil
 }
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func encode(t testing.TB, m *Message) []byte {
+	buf := new(bytes.Buffer)
+	if err := m.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	frame := encode(t, NewMessage(MAGIC, MSGStore, []byte("payload")))
+	m := &Message{}
+	if err := m.Decode(bytes.NewReader(frame)); err != nil || string(m.Data()) != "payload" {
+		t.Error("[Message.Decode] valid frame rejected: ", err)
+	}
+	corrupt := append([]byte{}, frame...)
+	corrupt[len(corrupt)-1] ^= 1
+	if err := (&Message{}).Decode(bytes.NewReader(corrupt)); err != ErrChecksum {
+		t.Error("[Message.Decode] corrupted payload accepted: ", err)
+	}
+	huge := append([]byte{}, frame[:20]...)
+	binary.LittleEndian.PutUint32(huge[12:], 1<<31)
+	if err := (&Message{}).Decode(bytes.NewReader(huge)); err != ErrFrameTooLarge {
+		t.Error("[Message.Decode] 2GiB frame accepted: ", err)
+	}
+	legacy := append([]byte{}, frame...)
+	binary.LittleEndian.PutUint32(legacy, legacyMagic)
+	if err := (&Message{}).Decode(bytes.NewReader(legacy)); err != ErrLegacyFrame {
+		t.Error("[Message.Decode] frame of the old layout not told apart: ", err)
+	}
+	if err := (&Message{}).DecodeHeader(bytes.NewReader(frame), 4); err != ErrFrameTooLarge {
+		t.Error("[Message.DecodeHeader] frame over the limit accepted: ", err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add(encode(f, NewMessage(MAGIC, MSGPing, nil)))
+	f.Add(encode(f, NewMessage(MAGIC, MSGFindNode, make([]byte, 20))))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m := &Message{}
+		if err := m.Decode(bytes.NewReader(data)); err != nil {
+			return
+		}
+		if DefaultMaxFrame < len(m.Data()) {
+			t.Fatal("decoded a frame over the limit")
+		}
+		again := &Message{}
+		if err := again.Decode(bytes.NewReader(encode(t, m))); err != nil {
+			t.Fatal("decoded frame does not encode back: ", err)
+		}
+		if again.code != m.code || again.id != m.id || !bytes.Equal(again.data, m.data) {
+			t.Fatal("decoded frame changed through encoding")
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"kad/node"
+	"kad/store"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+var mutableDomain = []byte("kad mutable")
+
+//ErrSeqTooLow a node holds the mutable record with a higher sequence number
+var ErrSeqTooLow = errors.New("sequence number too low")
+
+//PutMutable sign value with the key of owner and store it with sequence
+//number seq under the nodeid of the public key, ErrSeqTooLow if a node holds
+//a higher sequence number, this node republishes it until it is shut down
+func (s *Server) PutMutable(owner *node.Identity, seq uint64, value []byte) error {
+	if maxValueSize < len(value) {
+		return errors.New("value too large")
+	}
+	r := store.Record{
+		Key:       owner.ID,
+		Value:     value,
+		PublicKey: owner.PublicKey,
+		Seq:       seq,
+		Sig:       owner.Sign(mutableMessage(seq, value)),
+	}
+	if err := s.put(r); err != nil {
+		return err
+	}
+	s.publish(r)
+	return nil
+}
+
+//GetMutable find the valid record of the owner of pub with the highest
+//sequence number
+func (s *Server) GetMutable(pub ed25519.PublicKey) ([]byte, uint64, error) {
+	r, err := s.get(node.NewIDFromPublicKey(pub), true)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r.Value, r.Seq, nil
+}
+
+//mutableMessage the bytes the owner of a mutable record signs
+func mutableMessage(seq uint64, value []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(mutableDomain)
+	binary.Write(buf, binary.LittleEndian, seq)
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+//verifyMutable check that r is keyed by its public key and signed by it
+func verifyMutable(r store.Record) bool {
+	if !r.Mutable() || !r.Key.Equal(node.NewIDFromPublicKey(r.PublicKey)) {
+		return false
+	}
+	return node.Verify(r.PublicKey, mutableMessage(r.Seq, r.Value), r.Sig)
+}
+
+//handleStoreMutable store a mutable record once its signature is checked
+func (s *Server) handleStoreMutable(p *Peer, m *Message) error {
+	rd := bytes.NewReader(m.data)
+	var ttl uint32
+	if err := binary.Read(rd, binary.LittleEndian, &ttl); err != nil {
+		return err
+	}
+	r, err := decodeMutable(rd)
+	if err != nil {
+		return err
+	}
+	if !verifyMutable(r) {
+		golog.Warn("[server.handlestoremutable] bad signature from ", p.addr)
+		return s.sendError(p, m, "bad signature")
+	}
+	expires := s.scaledTTL(r.Key, s.recordTTL(ttl))
+	r.Expires = time.Now().Add(expires)
+	golog.Debug("[server.handlestoremutable] store ", r.Key.String(), " seq ", r.Seq, " from ", p.addr)
+	if err := s.keep(r); err != nil {
+		return s.sendError(p, m, err.Error())
+	}
+	return s.reply(p, m, MSGMutableStored, nil)
+}
+
+func encodeMutable(w io.Writer, r store.Record) error {
+	if len(r.PublicKey) != ed25519.PublicKeySize || len(r.Sig) != ed25519.SignatureSize {
+		return errors.New("malformed mutable record")
+	}
+	if _, err := w.Write(r.PublicKey); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, r.Seq); err != nil {
+		return err
+	}
+	if _, err := w.Write(r.Sig); err != nil {
+		return err
+	}
+	_, err := w.Write(r.Value)
+	return err
+}
+
+func decodeMutable(rd io.Reader) (store.Record, error) {
+	r := store.Record{
+		PublicKey: make(ed25519.PublicKey, ed25519.PublicKeySize),
+		Sig:       make([]byte, ed25519.SignatureSize),
+	}
+	if _, err := io.ReadFull(rd, r.PublicKey); err != nil {
+		return store.Record{}, err
+	}
+	if err := binary.Read(rd, binary.LittleEndian, &r.Seq); err != nil {
+		return store.Record{}, err
+	}
+	if _, err := io.ReadFull(rd, r.Sig); err != nil {
+		return store.Record{}, err
+	}
+	value, err := ioutil.ReadAll(io.LimitReader(rd, maxValueSize+1))
+	if err != nil {
+		return store.Record{}, err
+	}
+	if maxValueSize < len(value) {
+		return store.Record{}, errors.New("value too large")
+	}
+	r.Value = value
+	r.Key = node.NewIDFromPublicKey(r.PublicKey)
+	return r, nil
+}
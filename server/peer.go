@@ -1,54 +1,210 @@
 package server
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"kad/node"
-	"net"
+	"sync"
 	"time"
 
 	"github.com/kataras/golog"
 )
 
 const (
-	peerOut = 10 * time.Second
+	//peerOut how long a dialed connection may be idle before it is pinged,
+	//or closed if its node is not in the kbucket
+	peerOut = 30 * time.Second
+	//maxMissed how many keepalive pings in a row may go unanswered
+	maxMissed = 3
+	//writetm how long writing one message may take
+	writetm = 10 * time.Second
 )
 
+//ErrTooLarge the message does not fit in the transport of the peer
+var ErrTooLarge = errors.New("message too large for transport")
+
+//writeDeadliner a connection whose writes can time out
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
 //Peer a remote node
 type Peer struct {
-	id     node.NodeID
-	addr   string
-	conn   *net.TCPConn
-	timer  *time.Timer
-	done   chan error
-	closed bool
+	id       node.NodeID
+	verified bool
+	greeted  bool
+	//dialed addr can be dialed back, this node dialed it or it carries
+	//datagrams, unlike the ephemeral source of an accepted connection
+	dialed  bool
+	contact string
+	version uint16
+	caps    Capability
+	idmu    sync.Mutex
+	addr    string
+	conn    io.WriteCloser
+	max     int
+	timer   *time.Timer
+	quit    chan struct{}
+	once    sync.Once
+	wmu     sync.Mutex
+	//keepalive called by run when the connection is idle, nil for none
+	keepalive func(p *Peer)
+	//missed unanswered keepalive pings, only used by keepalive
+	missed int
+	//used when the peer last carried a request other than a ping
+	used time.Time
 }
 
-func NewPeer(addr string, conn *net.TCPConn) *Peer {
+//NewPeer create a peer writing to conn, max limits the size of an encoded
+//message, 0 for no limit
+func NewPeer(addr string, conn io.WriteCloser, max int) *Peer {
 	p := &Peer{
-		addr:   conn.RemoteAddr().String(),
-		conn:   conn,
-		done:   make(chan error, 1),
-		closed: false,
+		addr: addr,
+		conn: conn,
+		max:  max,
+		quit: make(chan struct{}),
+		used: time.Now(),
 	}
 	p.timer = time.NewTimer(peerOut)
 	go p.run()
 	return p
 }
 
+//run call keepalive whenever nothing was written for peerOut, until the peer
+//is closed
 func (p *Peer) run() {
 	for {
 		select {
 		case <-p.timer.C:
-			// err := p.server.sendPing(p)
-			// if err != nil {
-			// 	golog.Error(err)
-			// }
-			continue
+			if f := p.getKeepalive(); f != nil {
+				f(p)
+			}
+			p.timer.Reset(peerOut)
+		case <-p.quit:
+			return
 		}
 	}
 }
 
+//setKeepalive set the function pinging the peer when it is idle
+func (p *Peer) setKeepalive(f func(p *Peer)) {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	p.keepalive = f
+}
+
+func (p *Peer) getKeepalive() func(p *Peer) {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	return p.keepalive
+}
+
 func (p *Peer) SetID(id node.NodeID) {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	if !p.verified {
+		p.id = id
+	}
+}
+
+//ID the nodeid of the peer, verified tells whether the transport
+//authenticated it
+func (p *Peer) ID() (id node.NodeID, verified bool) {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	return p.id, p.verified
+}
+
+//setVerifiedID bind the peer to the nodeid authenticated by the transport
+func (p *Peer) setVerifiedID(id node.NodeID) {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
 	p.id = id
+	p.verified = true
+}
+
+//Greeted whether this node pinged the peer, so the peer knows it
+func (p *Peer) Greeted() bool {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	return p.greeted
+}
+
+func (p *Peer) setGreeted() {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	p.greeted = true
+}
+
+//Dialed whether the node of the peer can be dialed at its address
+func (p *Peer) Dialed() bool {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	return p.dialed
+}
+
+func (p *Peer) setDialed() {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	p.dialed = true
+}
+
+//setContact record the address the node of the peer is dialed on
+func (p *Peer) setContact(addr string) {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	p.contact = addr
+}
+
+//Node the node of the peer, known once it pinged or was pinged
+func (p *Peer) Node() (node.Node, bool) {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	if p.contact == "" || p.id.Equal(node.NodeID{}) {
+		return node.Node{}, false
+	}
+	return node.Node{ID: p.id, Addr: p.contact}, true
+}
+
+func (p *Peer) setProtocol(version uint16, caps Capability) {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	p.version = version
+	p.caps = caps
+}
+
+//Version the protocol version announced by the peer, 0 before a handshake
+func (p *Peer) Version() uint16 {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	return p.version
+}
+
+//Supports whether the peer announced all the capabilities in c
+func (p *Peer) Supports(c Capability) bool {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	return p.caps&c == c
+}
+
+//touch record a request to or from the peer
+func (p *Peer) touch() {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	p.used = time.Now()
+}
+
+//idle how long the peer carried no request but pings
+func (p *Peer) idle() time.Duration {
+	p.idmu.Lock()
+	defer p.idmu.Unlock()
+	return time.Since(p.used)
+}
+
+//String the address of the peer, so logging a peer reads no guarded field
+func (p *Peer) String() string {
+	return p.addr
 }
 
 //Disconnect
@@ -58,12 +214,28 @@ func (p *Peer) Disconnect(err error) {
 }
 
 func (p *Peer) Write(m *Message) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	buf := new(bytes.Buffer)
+	if err := m.Encode(buf); err != nil {
+		return err
+	}
+	if 0 < p.max && p.max < buf.Len() {
+		return ErrTooLarge
+	}
 	p.timer.Reset(peerOut)
-	return m.Encode(p.conn)
+	if dl, ok := p.conn.(writeDeadliner); ok {
+		dl.SetWriteDeadline(time.Now().Add(writetm))
+	}
+	_, err := p.conn.Write(buf.Bytes())
+	return err
 }
 
 func (p *Peer) close(err error) {
-	golog.Warn("[peer.close] close peer: ", p.addr)
-	p.timer.Stop()
-	p.conn.Close()
+	p.once.Do(func() {
+		golog.Warn("[peer.close] close peer: ", p.addr)
+		close(p.quit)
+		p.timer.Stop()
+		p.conn.Close()
+	})
 }
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"kad/node"
+	"kad/store"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+const (
+	providerTTL = 24 * time.Hour
+	//maxProvidersReply how many providers a GET_PROVIDERS reply carries
+	maxProvidersReply = 20
+)
+
+//Provide announce this node provides the content of key to the k closest
+//nodes to the key, the announcement is republished until shutdown
+func (s *Server) Provide(key []byte) error {
+	id := node.NewIDFromKey(key)
+	s.announce(id)
+	return s.provide(id)
+}
+
+func (s *Server) provide(id node.NodeID) error {
+	ns, err := s.FindNode(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	self := node.Node{
+		ID:   s.config.ID,
+		Addr: s.config.Advertise,
+	}
+	stored := 0
+	if dialable(self.Addr) && s.isClosest(id, ns) {
+		err := s.providers.AddProvider(store.Provider{
+			Key:     id,
+			Node:    self,
+			Expires: time.Now().Add(providerTTL),
+		})
+		if err != nil {
+			golog.Error("[server.provide] ", err)
+		} else {
+			stored++
+		}
+	}
+	for _, n := range ns {
+		if err := s.sendAddProvider(context.Background(), n, id, providerTTL); err != nil {
+			golog.Warn("[server.provide] announce to ", n.Addr, " failed: ", err)
+			continue
+		}
+		stored++
+	}
+	if stored == 0 {
+		return errors.New("no node to announce the provider to")
+	}
+	return nil
+}
+
+//FindProviders look up the providers of key, they are sent on the returned
+//channel as they are found, it is closed once count providers are found or
+//the lookup ends, it is closed at once if count is not positive
+func (s *Server) FindProviders(ctx context.Context, key []byte, count int) <-chan node.Node {
+	id := node.NewIDFromKey(key)
+	if count <= 0 {
+		out := make(chan node.Node)
+		close(out)
+		return out
+	}
+	out := make(chan node.Node, count)
+	go func() {
+		defer close(out)
+		seen := map[node.NodeID]bool{}
+		emit := func(ns []node.Node) bool {
+			for _, n := range ns {
+				if count <= len(seen) {
+					return true
+				}
+				if seen[n.ID] {
+					continue
+				}
+				seen[n.ID] = true
+				out <- n
+			}
+			return count <= len(seen)
+		}
+		local, err := s.providers.Providers(id)
+		if err != nil {
+			golog.Error("[server.findproviders] ", err)
+		}
+		ns := make([]node.Node, len(local))
+		for i, p := range local {
+			ns[i] = p.Node
+		}
+		if emit(ns) {
+			return
+		}
+		_, err = s.walk(ctx, id, MSGGetProviders, func(r reply) bool {
+			return emit(r.providers)
+		})
+		if err != nil {
+			golog.Warn("[server.findproviders] ", err)
+		}
+	}()
+	return out
+}
+
+func (s *Server) sendAddProvider(ctx context.Context, n node.Node, id node.NodeID, ttl time.Duration) error {
+	buf := new(bytes.Buffer)
+	if err := encodeID(buf, id); err != nil {
+		return err
+	}
+	sec := uint32(ttl / time.Second)
+	if err := binary.Write(buf, binary.LittleEndian, &sec); err != nil {
+		return err
+	}
+	_, err := s.CallNode(ctx, n, NewMessage(MAGIC, MSGAddProvider, buf.Bytes()))
+	return err
+}
+
+//handleAddProvider record the sender as a provider of the key, a node can
+//only announce itself at an address it was verified at
+func (s *Server) handleAddProvider(p *Peer, m *Message) error {
+	r := bytes.NewReader(m.data)
+	id, err := decodeID(r)
+	if err != nil {
+		return err
+	}
+	var sec uint32
+	if err := binary.Read(r, binary.LittleEndian, &sec); err != nil {
+		return err
+	}
+	ttl := time.Duration(sec) * time.Second
+	if providerTTL < ttl {
+		ttl = providerTTL
+	}
+	from, ok := s.verified(p)
+	if !ok {
+		return s.sendError(p, m, "unknown node or unverified address, ping first")
+	}
+	golog.Debug("[server.handleaddprovider] ", from.Addr, " provides ", id.String())
+	err = s.providers.AddProvider(store.Provider{
+		Key:     id,
+		Node:    from,
+		Expires: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+	return s.reply(p, m, MSGProviderAdded, nil)
+}
+
+//handleGetProviders reply the known providers of the key and the closest
+//nodes to it
+func (s *Server) handleGetProviders(p *Peer, m *Message) error {
+	id, err := decodeID(bytes.NewReader(m.data))
+	if err != nil {
+		return err
+	}
+	local, err := s.providers.Providers(id)
+	if err != nil {
+		return err
+	}
+	providers := []node.Node{}
+	for _, v := range local {
+		if maxProvidersReply <= len(providers) {
+			break
+		}
+		providers = append(providers, v.Node)
+	}
+	ns, err := s.config.Kbucket.FindN(id, s.config.Kbucket.K())
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	if err := encodeNodes(buf, providers); err != nil {
+		return err
+	}
+	if err := encodeNodes(buf, ns); err != nil {
+		return err
+	}
+	return s.reply(p, m, MSGProviders, buf.Bytes())
+}
+
+func decodeProviders(data []byte) (reply, error) {
+	r := bytes.NewReader(data)
+	providers, err := decodeNodes(r)
+	if err != nil {
+		return reply{}, err
+	}
+	ns, err := decodeNodes(r)
+	if err != nil {
+		return reply{}, err
+	}
+	return reply{
+		providers: providers,
+		nodes:     ns,
+	}, nil
+}
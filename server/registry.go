@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/kataras/golog"
+)
+
+const (
+	//ProtocolVersion the version of the wire protocol spoken by this node,
+	//2 added the frame checksum, 3 the puzzle difficulty to the handshake
+	ProtocolVersion uint16 = 3
+	//difficultyVersion the first version whose handshake carries the puzzle
+	//difficulty
+	difficultyVersion uint16 = 3
+	//minVersion the oldest version this node still talks to
+	minVersion uint16 = 2
+)
+
+//Capability a bit of the bitmap a node announces in its handshake
+type Capability uint64
+
+const (
+	//CapDHT the node serves the kademlia rpcs
+	CapDHT Capability = 1 << iota
+	//CapProviders the node keeps provider records
+	CapProviders
+	//CapMutable the node keeps signed mutable records
+	CapMutable
+)
+
+//Handler handle the request m from p, it answers with Server.Reply, an
+//error closes the connection
+type Handler func(s *Server, p *Peer, m *Message) error
+
+//RemoteError the error reply of a node which could not handle a request
+type RemoteError struct {
+	Code   uint32
+	Reason string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error on code 0x%04X: %s", e.Code, e.Reason)
+}
+
+//RegisterMessage add a request type and its response type with their codes,
+//it must be called before any server starts, usually from an init function
+func RegisterMessage(req MessageType, reqCode uint32, resp MessageType, respCode uint32) error {
+	if reqCode == respCode {
+		return errors.New("request and response share a code")
+	}
+	for t, c := range CodeMap {
+		if t == req || t == resp {
+			return errors.New("message type already registered: " + string(t))
+		}
+		if c == reqCode || c == respCode {
+			return fmt.Errorf("message code 0x%04X already registered", c)
+		}
+	}
+	CodeMap[req] = reqCode
+	CodeMap[resp] = respCode
+	ResponseOf[req] = resp
+	return nil
+}
+
+//Register serve the requests of type mtype with h, c is announced in the
+//handshake so other nodes know this node serves them, 0 for none
+func (s *Server) Register(mtype MessageType, c Capability, h Handler) error {
+	code, ok := CodeMap[mtype]
+	if !ok || isResponse(code) {
+		return errors.New("not a registered request type: " + string(mtype))
+	}
+	s.hmu.Lock()
+	defer s.hmu.Unlock()
+	if _, ok := s.handlers[code]; ok {
+		return errors.New("request type already handled: " + string(mtype))
+	}
+	s.handlers[code] = h
+	s.caps |= c
+	return nil
+}
+
+func (s *Server) handler(code uint32) (Handler, bool) {
+	s.hmu.RLock()
+	defer s.hmu.RUnlock()
+	h, ok := s.handlers[code]
+	return h, ok
+}
+
+//capabilities the bitmap announced in the handshake
+func (s *Server) capabilities() Capability {
+	s.hmu.RLock()
+	defer s.hmu.RUnlock()
+	return s.caps
+}
+
+//Reply send the response of type mtype to the request req
+func (s *Server) Reply(p *Peer, req *Message, mtype MessageType, data []byte) error {
+	return s.reply(p, req, mtype, data)
+}
+
+//sendError reply req with an error instead of a response
+func (s *Server) sendError(p *Peer, req *Message, reason string) error {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, req.code)
+	buf.WriteString(reason)
+	return s.reply(p, req, MSGError, buf.Bytes())
+}
+
+func decodeError(data []byte) error {
+	r := bytes.NewReader(data)
+	e := &RemoteError{}
+	if err := binary.Read(r, binary.LittleEndian, &e.Code); err != nil {
+		return err
+	}
+	reason, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	e.Reason = string(reason)
+	return e
+}
+
+//handleUnknown reject a request nobody handles, a response to nothing is
+//only logged
+func (s *Server) handleUnknown(p *Peer, m *Message) error {
+	golog.Warn("[server.handleunknown] unknown code ", m.code, " from ", p.addr)
+	if m.id == 0 {
+		return nil
+	}
+	return s.sendError(p, m, "unknown message code")
+}
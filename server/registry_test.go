@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"kad/node"
+	"testing"
+)
+
+const (
+	msgEcho   MessageType = "echo"
+	msgEchoed MessageType = "echoed"
+	capEcho   Capability  = 1 << 32
+)
+
+func init() {
+	if err := RegisterMessage(msgEcho, 0x00E1, msgEchoed, 0x01E1); err != nil {
+		panic(err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	if err := RegisterMessage("other", 0x00E1, "othered", 0x01E2); err == nil {
+		t.Error("[RegisterMessage] a code registered twice")
+	}
+	c := NewCluster(2, NewMemNetwork(0, 0, 1))
+	defer c.Close()
+	err := c.Servers[0].Register(msgEcho, capEcho, func(s *Server, p *Peer, m *Message) error {
+		return s.Reply(p, m, msgEchoed, m.Data())
+	})
+	if err != nil {
+		t.Fatal("[Server.Register] ", err)
+	}
+	src := c.Servers[1]
+	dst := node.Node{ID: c.Servers[0].config.ID, Addr: c.Servers[0].config.Addr}
+	p, err := src.connect(dst.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.ping(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Version() != ProtocolVersion || !p.Supports(CapDHT|capEcho) {
+		t.Error("[Server.ping] protocol of the peer not learned")
+	}
+	resp, err := src.CallNode(context.Background(), dst, NewMessage(MAGIC, msgEcho, []byte("hi")))
+	if err != nil || string(resp.Data()) != "hi" {
+		t.Error("[Server.CallNode] echo failed: ", err)
+	}
+	_, err = c.Servers[0].CallNode(context.Background(), node.Node{ID: src.config.ID, Addr: src.config.Addr}, NewMessage(MAGIC, msgEcho, nil))
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Code != 0x00E1 {
+		t.Error("[Server.CallNode] unhandled code not rejected: ", err)
+	}
+}
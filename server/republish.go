@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"kad/node"
+	"kad/store"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+//publish remember r was published by this node so it is published again
+//every RepublishInterval
+func (s *Server) publish(r store.Record) {
+	s.pubmu.Lock()
+	defer s.pubmu.Unlock()
+	s.published[r.Key] = r
+}
+
+//announce remember this node provides id so it is announced again every
+//RepublishInterval
+func (s *Server) announce(id node.NodeID) {
+	s.pubmu.Lock()
+	defer s.pubmu.Unlock()
+	s.provided[id] = true
+}
+
+//republishAll publish again the values and provider announcements of this
+//node before they expire on the nodes storing them
+func (s *Server) republishAll() {
+	s.pubmu.Lock()
+	records := make([]store.Record, 0, len(s.published))
+	for _, r := range s.published {
+		records = append(records, r)
+	}
+	provided := make([]node.NodeID, 0, len(s.provided))
+	for id := range s.provided {
+		provided = append(provided, id)
+	}
+	s.pubmu.Unlock()
+	for _, r := range records {
+		if err := s.put(r); err != nil {
+			golog.Warn("[server.republishall] put ", r.Key.String(), ": ", err)
+		}
+	}
+	for _, id := range provided {
+		if err := s.provide(id); err != nil {
+			golog.Warn("[server.republishall] provide ", id.String(), ": ", err)
+		}
+	}
+}
+
+//replicateAll drop the expired records and copy the others to the k closest
+//nodes to their key this node knows, so a record survives its storing nodes
+//leaving the network
+func (s *Server) replicateAll() {
+	now := time.Now()
+	if err := s.store.Expire(now); err != nil {
+		golog.Error("[server.replicateall] ", err)
+	}
+	if err := s.providers.Expire(now); err != nil {
+		golog.Error("[server.replicateall] ", err)
+	}
+	rs := []store.Record{}
+	err := s.store.Iterate(func(r store.Record) bool {
+		rs = append(rs, r)
+		return true
+	})
+	if err != nil {
+		golog.Error("[server.replicateall] ", err)
+		return
+	}
+	for _, r := range rs {
+		ns, err := s.config.Kbucket.FindN(r.Key, s.config.Kbucket.K())
+		if err != nil {
+			golog.Error("[server.replicateall] ", err)
+			continue
+		}
+		for _, n := range ns {
+			if err := s.sendStore(context.Background(), n, r); err != nil {
+				golog.Warn("[server.replicateall] store on ", n.Addr, " failed: ", err)
+			}
+		}
+	}
+}
+
+//scaledTTL the time a record sent with ttl lives on this node, it is halved
+//for every node beyond the k closest to the key which is closer than this
+//node, so the copies cached far from the key do not outlive the ones close
+//to it
+func (s *Server) scaledTTL(id node.NodeID, ttl time.Duration) time.Duration {
+	k := s.config.Kbucket.K()
+	ns, err := s.config.Kbucket.FindN(id, 2*k)
+	if err != nil {
+		return ttl
+	}
+	self, err := node.CalDistance(s.config.ID, id)
+	if err != nil {
+		return ttl
+	}
+	closer := 0
+	for _, n := range ns {
+		d, err := node.CalDistance(n.ID, id)
+		if err == nil && d.Compare(self) < 0 {
+			closer++
+		}
+	}
+	return scaleTTL(ttl, closer, k)
+}
+
+func scaleTTL(ttl time.Duration, closer, k int) time.Duration {
+	if closer < k {
+		return ttl
+	}
+	shift := uint(closer - k + 1)
+	if 62 < shift {
+		return 0
+	}
+	return ttl >> shift
+}
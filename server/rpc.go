@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"kad/node"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+//handletm how long a handler registered with Handle may run
+const handletm = 30 * time.Second
+
+//ErrNodeNotFound no node with the requested nodeid was found in the network
+var ErrNodeNotFound = errors.New("node not found")
+
+//HandlerFunc answer the payload of a request from a node, the error is sent
+//back to the requester as a RemoteError
+type HandlerFunc func(ctx context.Context, from node.Node, payload []byte) ([]byte, error)
+
+//Handle serve the requests with code by h, the code must not be used by a
+//registered message type, h runs in its own goroutine and only sees requests
+//of nodes which proved their nodeid and the address they advertise
+func (s *Server) Handle(code uint32, h HandlerFunc) error {
+	for _, c := range CodeMap {
+		if c == code {
+			return errors.New("code used by a registered message type")
+		}
+	}
+	s.hmu.Lock()
+	defer s.hmu.Unlock()
+	if _, ok := s.handlers[code]; ok {
+		return errors.New("code already handled")
+	}
+	s.handlers[code] = func(s *Server, p *Peer, m *Message) error {
+		from, ok := s.verified(p)
+		if !ok {
+			return s.sendError(p, m, "unknown node or unverified address, ping first")
+		}
+		go s.serveRequest(p, m, from, h)
+		return nil
+	}
+	return nil
+}
+
+func (s *Server) serveRequest(p *Peer, m *Message, from node.Node, h HandlerFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), handletm)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	resp, err := h(ctx, from, m.data)
+	if err != nil {
+		err = s.sendError(p, m, err.Error())
+	} else {
+		err = s.reply(p, m, MSGReply, resp)
+	}
+	if err != nil {
+		golog.Warn("[server.serverequest] reply to ", p.addr, " failed: ", err)
+	}
+}
+
+//Request send payload with code to the node nid, found through the kbucket
+//or by a lookup, and wait for the reply of its handler
+func (s *Server) Request(ctx context.Context, nid node.NodeID, code uint32, payload []byte) ([]byte, error) {
+	n, err := s.locate(ctx, nid)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{
+		magic:  MAGIC,
+		code:   code,
+		length: uint32(len(payload)),
+		data:   payload,
+	}
+	resp, err := s.CallNode(ctx, n, msg)
+	if err != nil {
+		return nil, err
+	}
+	if resp.code != CodeMap[MSGReply] {
+		return nil, errors.New("unexpected response code")
+	}
+	return resp.data, nil
+}
+
+//locate find the address of nid, looking it up if it is not in the kbucket
+func (s *Server) locate(ctx context.Context, nid node.NodeID) (node.Node, error) {
+	if n, err := s.config.Kbucket.FindOne(nid); err == nil && n.ID.Equal(nid) {
+		return n, nil
+	}
+	ns, err := s.FindNode(ctx, nid)
+	if err != nil {
+		return node.Node{}, err
+	}
+	if len(ns) == 0 || !ns[0].ID.Equal(nid) {
+		return node.Node{}, ErrNodeNotFound
+	}
+	return ns[0], nil
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"kad/node"
+	"testing"
+)
+
+func TestHandleRequest(t *testing.T) {
+	c := NewCluster(8, NewMemNetwork(0, 0, 1))
+	defer c.Close()
+	dst := c.Servers[5]
+	var caller node.NodeID
+	err := dst.Handle(0x0A01, func(ctx context.Context, from node.Node, payload []byte) ([]byte, error) {
+		caller = from.ID
+		if len(payload) == 0 {
+			return nil, errors.New("empty payload")
+		}
+		return bytes.ToUpper(payload), nil
+	})
+	if err != nil {
+		t.Fatal("[Server.Handle] ", err)
+	}
+	if err := dst.Handle(CodeMap[MSGPing], nil); err == nil {
+		t.Error("[Server.Handle] the code of ping taken")
+	}
+	src := c.Servers[2]
+	resp, err := src.Request(context.Background(), dst.config.ID, 0x0A01, []byte("hi"))
+	if err != nil || string(resp) != "HI" {
+		t.Fatal("[Server.Request] ", string(resp), " ", err)
+	}
+	if !caller.Equal(src.config.ID) {
+		t.Error("[Server.Handle] the handler does not see the requester")
+	}
+	_, err = src.Request(context.Background(), dst.config.ID, 0x0A01, nil)
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Reason != "empty payload" {
+		t.Error("[Server.Request] the error of the handler is lost: ", err)
+	}
+	if _, err := src.Request(context.Background(), node.NewNodeID(), 0x0A01, nil); err != ErrNodeNotFound {
+		t.Error("[Server.Request] request to a missing node: ", err)
+	}
+}
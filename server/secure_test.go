@@ -0,0 +1,44 @@
+package server
+
+import (
+	"kad/node"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSecure(t *testing.T) {
+	a, _ := node.NewIdentity()
+	b, _ := node.NewIdentity()
+	aconf, err := newTLSConfig(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bconf, err := newTLSConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	ids := make(chan node.NodeID, 1)
+	errs := make(chan error, 1)
+	go func() {
+		_, nid, err := acceptSecure(c2, bconf, time.Second)
+		ids <- nid
+		errs <- err
+	}()
+	_, nid, err := dialSecure(c1, aconf, time.Second)
+	if err != nil {
+		t.Fatal("[dialSecure] ", err)
+	}
+	if !nid.Equal(b.ID) {
+		t.Error("[dialSecure] remote id != id of the remote key")
+	}
+	if !(<-ids).Equal(a.ID) {
+		t.Error("[acceptSecure] remote id != id of the remote key")
+	}
+	if err := <-errs; err != nil {
+		t.Error("[acceptSecure] ", err)
+	}
+}
@@ -1,10 +1,15 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
-	"kad/config"
+	"io"
 	"kad/kbucket"
 	"kad/node"
+	"kad/store"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kataras/golog"
@@ -12,55 +17,214 @@ import (
 
 //Config configuration of a server
 type Config struct {
-	Addr    string
-	ID      node.NodeID
-	Kbucket *kbucket.Kbucket
-	Seeds   []string
+	//Addr the address to listen on
+	Addr string
+	//Advertise the address other nodes dial, sent in pings, Addr if empty,
+	//a missing host is filled with the address the pings come from
+	Advertise string
+	//ID the nodeid, NewServer derives it from Identity
+	ID       node.NodeID
+	Identity *node.Identity
+	Kbucket  *kbucket.Kbucket
+	Seeds    []string
+	Store    store.Datastore
+	//Providers the provider records, in memory if nil
+	Providers store.ProviderStore
+	//Network the transport of rpcs, "tcp" or "udp", messages too large
+	//for a datagram always go over tcp, udp has no transport security so it
+	//needs Plaintext
+	Network string
+	//NewTransport replace the network transports with a custom one
+	NewTransport func(s *Server) Transport
+	//Plaintext turn off tls on tcp connections, it allows the udp network
+	Plaintext bool
+	//RefreshInterval how long a bucket may go without lookups before it is
+	//refreshed, an hour by default
+	RefreshInterval time.Duration
+	//MaxFrameSize the largest payload accepted from a connection,
+	//DefaultMaxFrame if 0
+	MaxFrameSize uint32
+	//RecordTTL how long a stored value lives, a day by default
+	RecordTTL time.Duration
+	//RepublishInterval how often the values and provider announcements this
+	//node published are published again, a day by default
+	RepublishInterval time.Duration
+	//ReplicateInterval how often the stored values are copied to the k
+	//closest nodes known and expired records dropped, an hour by default
+	ReplicateInterval time.Duration
+	//DisjointPaths how many disjoint lookups run for every lookup, the nodes
+	//and values a majority of them agrees on are kept, 0 or 1 for a plain
+	//lookup
+	DisjointPaths int
+	//Difficulty the leading zero bits H(H(public key)) of the nodes must
+	//have to be added to the kbucket, it is advertised in the handshake, from 0
+	//to node.MaxDifficulty
+	Difficulty int
 }
 
+//ErrServerClosed the server is shut down
+var ErrServerClosed = errors.New("server closed")
+
 //Server a tcp server
 type Server struct {
 	config     Config
-	tran       *Transport
+	tran       Transport
+	stream     Transport
 	peers      map[string]*Peer
 	register   chan *Peer
 	unregister chan *Peer
 	quit       chan struct{}
+	quitOnce   sync.Once
 	errch      chan error
 	ticker     *time.Ticker
+	refresh    *time.Ticker
+	republish  *time.Ticker
+	replicate  *time.Ticker
+	published  map[node.NodeID]store.Record
+	provided   map[node.NodeID]bool
+	pubmu      sync.Mutex
+	mmu        sync.Mutex
+	getpeer    chan peerReq
+	pending    map[uint32]pending
+	pmu        sync.Mutex
+	nonces     *nonces
+	reach      *reach
+	tlsconf    *tls.Config
+	store      store.Datastore
+	providers  store.ProviderStore
+	handlers   map[uint32]Handler
+	caps       Capability
+	hmu        sync.RWMutex
+}
+
+//readDeadliner a connection whose reads can time out
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type peerReq struct {
+	addr  string
+	reply chan *Peer
 }
 
-//NewServer to create a new server
+//NewServer to create a new server, a new identity solving the puzzle of the
+//config difficulty is generated if the config has none
 func NewServer(config Config) *Server {
+	if config.Difficulty < 0 || node.MaxDifficulty < config.Difficulty {
+		golog.Fatal("[server.newserver] invalid puzzle difficulty ", config.Difficulty, ", it must be in 0..", node.MaxDifficulty)
+	}
+	if config.Identity == nil {
+		id, err := node.NewIdentityWithDifficulty(config.Difficulty)
+		if err != nil {
+			golog.Fatal(err)
+		}
+		config.Identity = id
+	}
+	if node.Difficulty(config.Identity.PublicKey) < config.Difficulty {
+		golog.Warn("[server.newserver] the nodeid does not solve the puzzle of difficulty ", config.Difficulty)
+	}
+	config.ID = config.Identity.ID
+	if config.Advertise == "" {
+		config.Advertise = config.Addr
+	}
+	var tlsconf *tls.Config
+	if !config.Plaintext {
+		var err error
+		tlsconf, err = newTLSConfig(config.Identity)
+		if err != nil {
+			golog.Fatal(err)
+		}
+	}
 	s := &Server{
+		tlsconf:    tlsconf,
 		config:     config,
 		peers:      make(map[string]*Peer, 64),
 		register:   make(chan *Peer),
+		quit:       make(chan struct{}),
+		nonces:     newNonces(),
+		reach:      newReach(),
 		unregister: make(chan *Peer),
 		errch:      make(chan error),
+		getpeer:    make(chan peerReq),
+		pending:    make(map[uint32]pending),
+		published:  make(map[node.NodeID]store.Record),
+		provided:   make(map[node.NodeID]bool),
+		handlers:   make(map[uint32]Handler),
+		store:      config.Store,
+	}
+	if s.store == nil {
+		s.store = store.NewMemStore()
+	}
+	s.providers = config.Providers
+	if s.providers == nil {
+		s.providers = store.NewMemProviders()
+	}
+	s.Register(MSGPing, 0, (*Server).handlePing)
+	s.Register(MSGFindNode, CapDHT, (*Server).handleFindNode)
+	s.Register(MSGStore, CapDHT, (*Server).handleStore)
+	s.Register(MSGFindValue, CapDHT, (*Server).handleFindValue)
+	s.Register(MSGAddProvider, CapProviders, (*Server).handleAddProvider)
+	s.Register(MSGGetProviders, CapProviders, (*Server).handleGetProviders)
+	s.Register(MSGStoreMutable, CapMutable, (*Server).handleStoreMutable)
+	if config.NewTransport != nil {
+		s.stream = config.NewTransport(s)
+		s.tran = s.stream
+	} else {
+		s.stream = NewTCPTransport(s)
+		s.tran = s.stream
+		if config.Network == "udp" {
+			if !config.Plaintext {
+				golog.Fatal("[server.newserver] udp has no transport security, it needs Plaintext")
+			}
+			s.tran = NewUDPTransport(s)
+		}
 	}
-	s.tran = NewTransport(s)
 	s.ticker = time.NewTicker(3 * time.Second)
+	if s.config.RefreshInterval <= 0 {
+		s.config.RefreshInterval = refreshtm
+	}
+	s.refresh = time.NewTicker(s.config.RefreshInterval)
+	if s.config.MaxFrameSize == 0 {
+		s.config.MaxFrameSize = DefaultMaxFrame
+	}
+	if s.config.RecordTTL <= 0 {
+		s.config.RecordTTL = recordTTL
+	}
+	if s.config.RepublishInterval <= 0 {
+		s.config.RepublishInterval = republishtm
+	}
+	if s.config.ReplicateInterval <= 0 {
+		s.config.ReplicateInterval = replicatetm
+	}
+	s.republish = time.NewTicker(s.config.RepublishInterval)
+	s.replicate = time.NewTicker(s.config.ReplicateInterval)
 	return s
 }
 
 const (
-	outtime = 5 * time.Second
+	outtime     = 5 * time.Second
+	refreshtm   = time.Hour
+	republishtm = 24 * time.Hour
+	replicatetm = time.Hour
+	//bootstrapConc how many bootstrap pings run at once
+	bootstrapConc = 16
+	//idletm how long a connection may stay without a frame
+	idletm = 2 * time.Minute
+	//frametm how long the payload of a frame may take to arrive
+	frametm = 10 * time.Second
 )
 
 //Start to start a server
 func (s *Server) Start() {
 	go func() {
-		for _, v := range s.config.Seeds {
-			p, err := s.tran.Dial(v, outtime)
-			if err != nil {
-				golog.Error("[server.tran.dia]", err)
-				continue
-			}
-			s.sendPing(p)
+		if err := s.Bootstrap(context.Background(), s.config.Seeds); err != nil {
+			golog.Error("[server.bootstrap] ", err)
 		}
 	}()
 	go s.tran.Accept()
+	if s.tran != s.stream {
+		go s.stream.Accept()
+	}
 	s.run()
 }
 
@@ -75,109 +239,211 @@ func (s *Server) run() {
 		case p := <-s.unregister:
 			golog.Info("[server.run] unregister peer: ", p)
 			s.removePeer(p)
+		case req := <-s.getpeer:
+			req.reply <- s.peers[req.addr]
+		case <-s.refresh.C:
+			go s.refreshBuckets()
+		case <-s.republish.C:
+			go s.republishAll()
+		case <-s.replicate.C:
+			go s.replicateAll()
 		case <-s.ticker.C:
 			golog.Info("[server.tick] ", s.peers)
 		case n := <-s.config.Kbucket.Ping:
-			err := s.dial(n)
-			if err != nil {
-				s.config.Kbucket.RemoveNode(n)
+			go s.check(n)
+		}
+	}
+}
+
+//handleConn register p and handle the messages read from r until it fails,
+//a connection idle for too long or stalling in a frame is closed
+func (s *Server) handleConn(p *Peer, r io.Reader) {
+	var err error
+	defer func() {
+		p.Disconnect(err)
+		select {
+		case s.unregister <- p:
+		case <-s.quit:
+		}
+	}()
+	select {
+	case s.register <- p:
+	case <-s.quit:
+		return
+	}
+	dl, _ := r.(readDeadliner)
+	for {
+		msg := &Message{}
+		if dl != nil {
+			dl.SetReadDeadline(time.Now().Add(idletm))
+		}
+		if err = msg.DecodeHeader(r, s.config.MaxFrameSize); err != nil {
+			if err == ErrLegacyFrame {
+				golog.Warn("[server.handleconn] ", p.addr, ": ", err)
+				return
 			}
+			golog.Error(err)
+			return
+		}
+		if dl != nil {
+			dl.SetReadDeadline(time.Now().Add(frametm))
+		}
+		if err = msg.DecodeData(r); err != nil {
+			golog.Error(err)
+			return
+		}
+		if err = s.handleMessage(p, msg); err != nil {
+			golog.Error(err)
+			return
 		}
 	}
 }
 
 func (s *Server) handleMessage(p *Peer, m *Message) error {
-	if m.code == CodeMap[MSGPing] {
-		return s.handlePing(p, m)
+	if isResponse(m.code) {
+		return s.handleResponse(p, m)
+	}
+	if m.code != CodeMap[MSGPing] {
+		p.touch()
 	}
-	if m.code == CodeMap[MSGPong] {
-		return s.handlePong(p, m)
+	h, ok := s.handler(m.code)
+	if !ok {
+		return s.handleUnknown(p, m)
 	}
-	return nil
+	return h(s, p, m)
 }
 
-func (s *Server) handlePing(p *Peer, m *Message) error {
-	nid, err := node.NewIDFromByte(m.data)
-	if err != nil {
-		golog.Error("[handleping] ", err)
-		return err
-	}
-	p.SetID(nid)
-	n := node.Node{
-		ID:   nid,
-		Addr: p.addr,
+func (s *Server) addPeer(p *Peer) {
+	if _, ok := s.peers[p.addr]; ok {
+		return
 	}
-	s.config.Kbucket.AddNode(n)
-	golog.Info("[server.handleping] recieve ping from node: ", p.addr, nid.String())
-	return s.sendPong(p, s.config.ID)
+	s.peers[p.addr] = p
 }
 
-func (s *Server) handlePong(p *Peer, m *Message) error {
-	nid, err := node.NewIDFromByte(m.data)
-	if err != nil {
-		return err
+//Bootstrap ping the seeds and the contacts restored by the kbucket, then
+//look up the own id to fill the kbucket
+func (s *Server) Bootstrap(ctx context.Context, seeds []string) error {
+	var alive int32
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, bootstrapConc)
+	try := func(addr string, nid *node.NodeID) {
+		defer wg.Done()
+		sem <- struct{}{}
+		defer func() { <-sem }()
+		p, err := s.connect(addr)
+		if err != nil {
+			golog.Warn("[server.bootstrap] dial ", addr, " ", err)
+			return
+		}
+		id, err := s.ping(ctx, p)
+		if err != nil {
+			golog.Warn("[server.bootstrap] ping ", addr, " ", err)
+			return
+		}
+		if nid != nil && !id.Equal(*nid) {
+			golog.Warn("[server.bootstrap] ", addr, " changed its nodeid")
+		}
+		atomic.AddInt32(&alive, 1)
 	}
-	p.SetID(nid)
-	n := node.Node{
-		ID:   nid,
-		Addr: p.addr,
+	for _, v := range seeds {
+		wg.Add(1)
+		go try(v, nil)
+	}
+	restored := s.config.Kbucket.Restored()
+	for i := range restored {
+		wg.Add(1)
+		go try(restored[i].Addr, &restored[i].ID)
 	}
-	golog.Info("[server.handlepong] recieve pong from node: ", p.addr, nid.String())
-	s.config.Kbucket.AddNode(n)
-	return nil
+	wg.Wait()
+	if alive == 0 && 0 < len(seeds)+len(restored) {
+		return errors.New("no seed or restored contact answered")
+	}
+	_, err := s.FindNode(ctx, s.config.ID)
+	return err
 }
 
-func (s *Server) sendPong(p *Peer, nid node.NodeID) error {
-	idbyte, err := nid.ToByte()
-	if err != nil {
-		return err
+//refreshBuckets look up a random id in every bucket idle for too long
+func (s *Server) refreshBuckets() {
+	for _, nid := range s.config.Kbucket.Idle(s.config.RefreshInterval) {
+		golog.Debug("[server.refresh] refresh bucket of ", nid.String())
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if _, err := s.FindNode(ctx, nid); err != nil {
+			golog.Warn("[server.refresh] ", err)
+		}
+		cancel()
 	}
-	msg := NewMessage(MAGIC, MSGPong, idbyte)
-	return p.Write(msg)
 }
-func (s *Server) sendPing(p *Peer) error {
-	id, err := config.NodeID.ToByte()
+
+//check ping a node the kbucket asked for, remove it if it does not answer
+func (s *Server) check(n node.Node) {
+	p, err := s.connect(n.Addr)
 	if err != nil {
-		return err
+		golog.Error("[server.check] err: ", err)
+		s.config.Kbucket.RemoveNode(n)
+		return
+	}
+	nid, err := s.ping(context.Background(), p)
+	if err != nil || !nid.Equal(n.ID) {
+		golog.Warn("[server.check] node ", n.Addr, " did not answer: ", err)
+		s.config.Kbucket.RemoveNode(n)
 	}
-	msg := NewMessage(MAGIC, MSGPing, id)
-	return p.Write(msg)
 }
-func (s *Server) addPeer(p *Peer) {
-	if _, ok := s.peers[p.addr]; ok {
-		return
+
+//connect get a peer of addr on the rpc transport
+func (s *Server) connect(addr string) (*Peer, error) {
+	if s.tran != s.stream {
+		return s.tran.Dial(addr, outtime)
 	}
-	s.peers[p.addr] = p
+	return s.connectStream(addr)
 }
-func (s *Server) dial(n node.Node) error {
-	if p, ok := s.peers[n.Addr]; ok {
-		return s.sendPing(p)
+
+//connectStream get the connected tcp peer of addr, dial it if there is none
+func (s *Server) connectStream(addr string) (*Peer, error) {
+	reply := make(chan *Peer, 1)
+	select {
+	case s.getpeer <- peerReq{addr: addr, reply: reply}:
+	case <-s.quit:
+		return nil, ErrServerClosed
 	}
-	p, err := s.tran.Dial(n.Addr, outtime)
-	if err != nil {
-		golog.Error("[server.dial] err: ", err)
-		return err
+	if p := <-reply; p != nil {
+		return p, nil
 	}
-	return s.sendPing(p)
+	return s.stream.Dial(addr, outtime)
 }
 
 func (s *Server) removePeer(p *Peer) {
-	delete(s.peers, p.addr)
+	s.failPending(p)
+	if s.peers[p.addr] == p {
+		delete(s.peers, p.addr)
+	}
+	id, _ := p.ID()
 	n := node.Node{
 		Addr: p.addr,
-		ID:   p.id,
+		ID:   id,
 	}
 	s.config.Kbucket.RemoveNode(n)
 }
 
+//Shutdown stop the server, Start returns after it
 func (s *Server) Shutdown() {
-	s.quit <- struct{}{}
+	s.quitOnce.Do(func() {
+		close(s.quit)
+	})
 }
 
 func (s *Server) close() {
 	s.tran.Close()
+	if s.tran != s.stream {
+		s.stream.Close()
+	}
 	for _, v := range s.peers {
 		v.Disconnect(errors.New("Stopped manully"))
 	}
 	s.ticker.Stop()
+	s.refresh.Stop()
+	s.republish.Stop()
+	s.replicate.Stop()
+	if err := s.config.Kbucket.Save(); err != nil {
+		golog.Error("[server.close] save kbucket: ", err)
+	}
 }
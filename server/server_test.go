@@ -0,0 +1,566 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"kad/kbucket"
+	"kad/node"
+	"kad/store"
+	"testing"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+func init() {
+	golog.SetLevel("error")
+}
+
+func TestClusterFindNode(t *testing.T) {
+	c := NewCluster(30, NewMemNetwork(0, 0, 1))
+	defer c.Close()
+	src := c.Servers[7]
+	dst := c.Servers[23]
+	ns, err := src.FindNode(context.Background(), dst.config.ID)
+	if err != nil {
+		t.Fatal("[Server.FindNode] ", err)
+	}
+	if len(ns) == 0 || !ns[0].ID.Equal(dst.config.ID) {
+		t.Error("[Server.FindNode] target is not the closest node found")
+	}
+	if len(ns) != src.config.Kbucket.K() {
+		t.Error("[Server.FindNode] found ", len(ns), " nodes, want k")
+	}
+}
+
+func TestClusterPutGet(t *testing.T) {
+	c := NewCluster(20, NewMemNetwork(time.Millisecond, 0, 1))
+	defer c.Close()
+	if err := c.Servers[3].Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal("[Server.Put] ", err)
+	}
+	v, err := c.Servers[15].Get([]byte("key"))
+	if err != nil {
+		t.Fatal("[Server.Get] ", err)
+	}
+	if string(v) != "value" {
+		t.Error("[Server.Get] value != 'value'")
+	}
+	if _, err := c.Servers[15].Get([]byte("nokey")); err == nil {
+		t.Error("[Server.Get] found a value never stored")
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	c := NewCluster(2, NewMemNetwork(0, 0, 1))
+	defer c.Close()
+	c.Network.SetDropRate(1)
+	s := c.Servers[1]
+	p, err := s.connect(c.Servers[0].config.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = s.ping(ctx, p)
+	if err != ErrTimeout {
+		t.Error("[Server.Call] err != ErrTimeout: ", err)
+	}
+}
+
+func TestVerifyPing(t *testing.T) {
+	c := NewCluster(1, NewMemNetwork(0, 0, 1))
+	defer c.Close()
+	s := c.Servers[0]
+	id, _ := node.NewIdentity()
+	pi := &ping{
+		pub:   id.PublicKey,
+		nonce: []byte("0123456789abcdef"),
+		ts:    time.Now().Unix(),
+	}
+	pi.sig = id.Sign(pi.signed())
+	if err := s.verifyPing(pi); err != nil {
+		t.Error("[Server.verifyPing] valid ping rejected: ", err)
+	}
+	if err := s.verifyPing(pi); err == nil {
+		t.Error("[Server.verifyPing] replayed ping accepted")
+	}
+	other, _ := node.NewIdentity()
+	pi.pub = other.PublicKey
+	pi.nonce = []byte("fedcba9876543210")
+	if err := s.verifyPing(pi); err == nil {
+		t.Error("[Server.verifyPing] ping signed by another key accepted")
+	}
+}
+
+func TestContactAddr(t *testing.T) {
+	cases := []struct {
+		adv, observed, want string
+	}{
+		{"", "10.0.0.1:40000", "10.0.0.1:40000"},
+		{"10.0.0.2:15200", "10.0.0.1:40000", "10.0.0.2:15200"},
+		{":15200", "10.0.0.1:40000", "10.0.0.1:15200"},
+		{"0.0.0.0:15200", "10.0.0.1:40000", "10.0.0.1:15200"},
+		{"[::]:15200", "[2001:db8::1]:40000", "[2001:db8::1]:15200"},
+		{"[2001:db8::2]:15200", "10.0.0.1:40000", "[2001:db8::2]:15200"},
+	}
+	for _, c := range cases {
+		addr, err := contactAddr(c.adv, c.observed)
+		if err != nil || addr != c.want {
+			t.Error("[contactAddr] ", c.adv, " seen at ", c.observed, " = ", addr, " ", err, ", want ", c.want)
+		}
+	}
+	if _, err := contactAddr("10.0.0.2", "10.0.0.1:40000"); err == nil {
+		t.Error("[contactAddr] address without port accepted")
+	}
+}
+
+func TestAdvertise(t *testing.T) {
+	c := NewCluster(1, NewMemNetwork(0, 0, 1))
+	defer c.Close()
+	start := func(addr string, adv string) *Server {
+		id, _ := node.NewIdentity()
+		n := &node.Node{ID: id.ID, Addr: addr}
+		s := NewServer(Config{
+			Addr:         addr,
+			Advertise:    adv,
+			Identity:     id,
+			Kbucket:      kbucket.New(n),
+			NewTransport: c.Network.Transport,
+		})
+		go s.Start()
+		<-s.tran.(*MemTransport).Ready()
+		p, err := s.connect(c.Servers[0].config.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ping(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	known := func(s *Server) (node.Node, bool) {
+		n, err := c.Servers[0].config.Kbucket.FindOne(s.config.ID)
+		return n, err == nil && n.ID.Equal(s.config.ID)
+	}
+	lost := start("10.0.9.1:15200", "10.9.9.9:15200")
+	defer lost.Shutdown()
+	filled := start("10.0.9.2:15200", ":15200")
+	defer filled.Shutdown()
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := known(lost); ok {
+		t.Error("[Server.handlePing] node added at an unreachable advertised address")
+	}
+	if n, ok := known(filled); !ok || n.Addr != "10.0.9.2:15200" {
+		t.Error("[Server.handlePing] node advertising only a port is not added at its host")
+	}
+}
+
+func TestInboundContact(t *testing.T) {
+	c := NewCluster(1, NewMemNetwork(0, 0, 1))
+	defer c.Close()
+	s := c.Servers[0]
+	observed := "10.0.9.3:40000"
+	local, remote := newMemPipe(c.Network, observed, s.config.Addr)
+	defer local.Close()
+	p := NewPeer(observed, remote, 0)
+	id, _ := node.NewIdentity()
+	pi := &ping{
+		pub:     id.PublicKey,
+		nonce:   []byte("0123456789abcdef"),
+		ts:      time.Now().Unix(),
+		version: ProtocolVersion,
+	}
+	pi.sig = id.Sign(pi.signed())
+	if err := s.handlePing(p, NewMessage(MAGIC, MSGPing, pi.encode())); err != nil {
+		t.Fatal("[Server.handlePing] ", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n, err := s.config.Kbucket.FindOne(id.ID); err == nil && n.ID.Equal(id.ID) {
+		t.Error("[Server.handlePing] node added at the source address of an accepted connection")
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	c := NewCluster(2, NewMemNetwork(0, 0, 1))
+	defer c.Close()
+	s := c.Servers[1]
+	dst := c.Servers[0].config.ID
+	p, err := s.connect(c.Servers[0].config.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ping(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	s.keepalive(p)
+	if p.missed != 0 {
+		t.Error("[Server.keepalive] answered ping counted as missed")
+	}
+	//the node stops answering pings but keeps the connection
+	c.Servers[0].hmu.Lock()
+	delete(c.Servers[0].handlers, CodeMap[MSGPing])
+	c.Servers[0].hmu.Unlock()
+	for i := 0; i < maxMissed; i++ {
+		s.keepalive(p)
+	}
+	select {
+	case <-p.quit:
+	case <-time.After(time.Second):
+		t.Error("[Server.keepalive] stale peer not closed")
+	}
+	if n, err := s.config.Kbucket.FindOne(dst); err == nil && n.ID.Equal(dst) {
+		t.Error("[Server.keepalive] stale node still in the kbucket")
+	}
+}
+
+func TestClusterProviders(t *testing.T) {
+	c := NewCluster(20, NewMemNetwork(time.Millisecond, 0, 1))
+	defer c.Close()
+	for _, i := range []int{3, 9} {
+		if err := c.Servers[i].Provide([]byte("file")); err != nil {
+			t.Fatal("[Server.Provide] ", err)
+		}
+	}
+	found := map[node.NodeID]bool{}
+	for n := range c.Servers[15].FindProviders(context.Background(), []byte("file"), 5) {
+		if n.Addr == "" {
+			t.Error("[Server.FindProviders] provider without address")
+		}
+		found[n.ID] = true
+	}
+	if len(found) != 2 || !found[c.Servers[3].config.ID] || !found[c.Servers[9].config.ID] {
+		t.Error("[Server.FindProviders] found ", len(found), " providers, want servers 3 and 9")
+	}
+	count := 0
+	for range c.Servers[15].FindProviders(context.Background(), []byte("file"), 1) {
+		count++
+	}
+	if count != 1 {
+		t.Error("[Server.FindProviders] ", count, " providers sent, want 1")
+	}
+	for range c.Servers[15].FindProviders(context.Background(), []byte("file"), -1) {
+		t.Error("[Server.FindProviders] provider sent for a negative count")
+	}
+}
+
+func TestClusterReplicate(t *testing.T) {
+	c := NewCluster(20, NewMemNetwork(time.Millisecond, 0, 1))
+	defer c.Close()
+	if err := c.Servers[3].Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal("[Server.Put] ", err)
+	}
+	id := node.NewIDFromKey([]byte("key"))
+	var holder *Server
+	for _, s := range c.Servers {
+		if _, ok := s.store.Get(id); ok {
+			holder = s
+			break
+		}
+	}
+	if holder == nil {
+		t.Fatal("[Server.Put] no server stored the value")
+	}
+	for _, s := range c.Servers {
+		if s != holder {
+			s.store.Delete(id)
+		}
+	}
+	holder.replicateAll()
+	ns, _ := holder.config.Kbucket.FindN(id, holder.config.Kbucket.K())
+	for _, n := range ns {
+		for _, s := range c.Servers {
+			if !s.config.ID.Equal(n.ID) {
+				continue
+			}
+			if _, ok := s.store.Get(id); !ok {
+				t.Error("[Server.replicateAll] value not copied to ", n.Addr)
+			}
+		}
+	}
+	for _, s := range c.Servers {
+		s.store.Delete(id)
+	}
+	c.Servers[3].republishAll()
+	if v, err := c.Servers[15].Get([]byte("key")); err != nil || string(v) != "value" {
+		t.Error("[Server.republishAll] value not published again: ", err)
+	}
+}
+
+func TestScaleTTL(t *testing.T) {
+	cases := []struct {
+		closer int
+		want   time.Duration
+	}{
+		{0, 8 * time.Hour},
+		{19, 8 * time.Hour},
+		{20, 4 * time.Hour},
+		{22, time.Hour},
+		{200, 0},
+	}
+	for _, v := range cases {
+		if got := scaleTTL(8*time.Hour, v.closer, 20); got != v.want {
+			t.Error("[scaleTTL] ", v.closer, " closer nodes: ", got, " want ", v.want)
+		}
+	}
+}
+
+func TestClusterMutable(t *testing.T) {
+	c := NewCluster(20, NewMemNetwork(time.Millisecond, 0, 1))
+	defer c.Close()
+	owner, err := node.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq, v := range []string{"v1", "v2"} {
+		if err := c.Servers[3].PutMutable(owner, uint64(seq+1), []byte(v)); err != nil {
+			t.Fatal("[Server.PutMutable] ", err)
+		}
+	}
+	v, seq, err := c.Servers[15].GetMutable(owner.PublicKey)
+	if err != nil {
+		t.Fatal("[Server.GetMutable] ", err)
+	}
+	if string(v) != "v2" || seq != 2 {
+		t.Error("[Server.GetMutable] got ", string(v), " seq ", seq, ", want v2 seq 2")
+	}
+	if v, err := c.Servers[9].Get(owner.PublicKey); err != nil || string(v) != "v2" {
+		t.Error("[Server.Get] mutable record not found: ", err)
+	}
+	if err := c.Servers[9].PutMutable(owner, 1, []byte("old")); err == nil {
+		t.Error("[Server.PutMutable] lower sequence number accepted")
+	}
+	forged := store.Record{
+		Key:       owner.ID,
+		Value:     []byte("forged"),
+		PublicKey: owner.PublicKey,
+		Seq:       3,
+		Sig:       owner.Sign(mutableMessage(3, []byte("v3"))),
+		Expires:   time.Now().Add(time.Hour),
+	}
+	ns, _ := c.Servers[9].FindNode(context.Background(), owner.ID)
+	if err := c.Servers[9].sendStore(context.Background(), ns[0], forged); err == nil {
+		t.Error("[Server.handleStoreMutable] forged record accepted")
+	}
+	if _, seq, _ := c.Servers[15].GetMutable(owner.PublicKey); seq != 2 {
+		t.Error("[Server.GetMutable] seq ", seq, " after a forged store, want 2")
+	}
+}
+
+func TestClusterDisjoint(t *testing.T) {
+	c := NewCluster(30, NewMemNetwork(time.Millisecond, 0, 1))
+	defer c.Close()
+	src := c.Servers[7]
+	src.config.DisjointPaths = 3
+	dst := c.Servers[23]
+	ns, err := src.FindNode(context.Background(), dst.config.ID)
+	if err != nil {
+		t.Fatal("[Server.FindNode] ", err)
+	}
+	if len(ns) == 0 || !ns[0].ID.Equal(dst.config.ID) {
+		t.Error("[Server.FindNode] target is not the closest node found by the disjoint paths")
+	}
+	if err := c.Servers[3].Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal("[Server.Put] ", err)
+	}
+	v, err := src.Get([]byte("key"))
+	if err != nil || string(v) != "value" {
+		t.Error("[Server.Get] disjoint lookup got ", string(v), ": ", err)
+	}
+}
+
+func TestAgreed(t *testing.T) {
+	target := node.NewNodeID()
+	paths := make([]*lookup, 3)
+	for i := range paths {
+		paths[i] = &lookup{
+			target: target,
+			k:      20,
+			seen:   map[string]bool{},
+		}
+	}
+	honest := node.Node{ID: node.NewNodeID(), Addr: "honest"}
+	sybil := node.Node{ID: node.NewNodeID(), Addr: "sybil"}
+	for _, l := range paths[:2] {
+		l.seen[honest.ID.String()] = true
+	}
+	paths[2].seen[sybil.ID.String()] = true
+	paths[0].shortlist = []*contact{{node: honest, queried: true, responded: true}}
+	paths[2].shortlist = []*contact{{node: sybil, queried: true, responded: true}}
+	ns := agreed(paths, target)
+	if len(ns) != 1 || !ns[0].ID.Equal(honest.ID) {
+		t.Error("[agreed] ", ns, " want only the node a majority heard of")
+	}
+	if v, ok := majority(map[int][]byte{0: []byte("a"), 1: []byte("b"), 2: []byte("a")}, 3); !ok || string(v) != "a" {
+		t.Error("[majority] value of 2 paths out of 3 not chosen")
+	}
+	if _, ok := majority(map[int][]byte{0: []byte("a"), 1: []byte("b")}, 3); ok {
+		t.Error("[majority] value of 1 path out of 3 chosen")
+	}
+}
+
+func TestPuzzle(t *testing.T) {
+	c := NewCluster(1, NewMemNetwork(0, 0, 1))
+	defer c.Close()
+	c.Servers[0].config.Difficulty = 8
+	weak, _ := node.NewIdentity()
+	for 8 <= node.Difficulty(weak.PublicKey) {
+		weak, _ = node.NewIdentity()
+	}
+	strong, _ := node.NewIdentityWithDifficulty(8)
+	for i, id := range []*node.Identity{weak, strong} {
+		addr := fmt.Sprintf("10.0.8.%d:15200", i+1)
+		s := NewServer(Config{
+			Addr:         addr,
+			Identity:     id,
+			Kbucket:      kbucket.New(&node.Node{ID: id.ID, Addr: addr}),
+			NewTransport: c.Network.Transport,
+		})
+		go s.Start()
+		<-s.tran.(*MemTransport).Ready()
+		defer s.Shutdown()
+		p, err := s.connect(c.Servers[0].config.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.ping(context.Background(), p)
+		if id == weak && err == nil {
+			t.Error("[Server.handlePing] nodeid without the puzzle solved accepted")
+		}
+		if id == strong && err != nil {
+			t.Error("[Server.handlePing] nodeid solving the puzzle rejected: ", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n, err := c.Servers[0].config.Kbucket.FindOne(weak.ID); err == nil && n.ID.Equal(weak.ID) {
+		t.Error("[Server.handlePing] nodeid without the puzzle solved added to the kbucket")
+	}
+}
+
+func TestProviderAddress(t *testing.T) {
+	c := NewCluster(1, NewMemNetwork(0, 0, 1))
+	defer c.Close()
+	id, _ := node.NewIdentity()
+	addr := "10.0.9.1:15200"
+	s := NewServer(Config{
+		Addr:         addr,
+		Advertise:    c.Servers[0].config.Addr,
+		Identity:     id,
+		Kbucket:      kbucket.New(&node.Node{ID: id.ID, Addr: addr}),
+		NewTransport: c.Network.Transport,
+	})
+	go s.Start()
+	<-s.tran.(*MemTransport).Ready()
+	defer s.Shutdown()
+	p, err := s.connect(c.Servers[0].config.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ping(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	key := node.NewIDFromKey([]byte("file"))
+	dst := node.Node{ID: c.Servers[0].config.ID, Addr: c.Servers[0].config.Addr}
+	if err := s.sendAddProvider(context.Background(), dst, key, time.Hour); err == nil {
+		t.Error("[Server.handleAddProvider] provider accepted at an address it does not own")
+	}
+	if ps, _ := c.Servers[0].providers.Providers(key); len(ps) != 0 {
+		t.Error("[Server.handleAddProvider] provider recorded at ", ps[0].Node.Addr)
+	}
+}
+
+func TestProviderAdvertise(t *testing.T) {
+	c := NewCluster(3, NewMemNetwork(0, 0, 1))
+	defer c.Close()
+	id, _ := node.NewIdentity()
+	addr := "10.0.9.1:15200"
+	s := NewServer(Config{
+		Addr:         addr,
+		Advertise:    ":15200",
+		Identity:     id,
+		Kbucket:      kbucket.New(&node.Node{ID: id.ID, Addr: addr}),
+		NewTransport: c.Network.Transport,
+	})
+	go s.Start()
+	<-s.tran.(*MemTransport).Ready()
+	defer s.Shutdown()
+	if err := s.Bootstrap(context.Background(), []string{c.Servers[0].config.Addr}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Provide([]byte("file")); err != nil {
+		t.Fatal("[Server.Provide] ", err)
+	}
+	key := node.NewIDFromKey([]byte("file"))
+	if ps, _ := s.providers.Providers(key); len(ps) != 0 {
+		t.Error("[Server.provide] local provider recorded at ", ps[0].Node.Addr)
+	}
+	found := false
+	for n := range c.Servers[1].FindProviders(context.Background(), []byte("file"), 1) {
+		if !n.ID.Equal(id.ID) || n.Addr != addr {
+			t.Error("[Server.FindProviders] provider found at ", n.Addr, ", want ", addr)
+		}
+		found = true
+	}
+	if !found {
+		t.Error("[Server.FindProviders] provider advertising only a port not found")
+	}
+}
+
+func TestStoreTTL(t *testing.T) {
+	c := NewCluster(2, NewMemNetwork(0, 0, 1))
+	defer c.Close()
+	dst := node.Node{ID: c.Servers[0].config.ID, Addr: c.Servers[0].config.Addr}
+	owner, _ := node.NewIdentity()
+	rs := []store.Record{
+		{Key: node.NewIDFromKey([]byte("key")), Value: []byte("value")},
+		{
+			Key:       owner.ID,
+			Value:     []byte("value"),
+			PublicKey: owner.PublicKey,
+			Seq:       1,
+			Sig:       owner.Sign(mutableMessage(1, []byte("value"))),
+		},
+	}
+	for _, r := range rs {
+		r.Expires = time.Now().Add(100 * 365 * 24 * time.Hour)
+		if err := c.Servers[1].sendStore(context.Background(), dst, r); err != nil {
+			t.Fatal("[Server.sendStore] ", err)
+		}
+		stored, ok := c.Servers[0].store.Get(r.Key)
+		if !ok {
+			t.Fatal("[Server.handleStore] record not stored")
+		}
+		if time.Now().Add(recordTTL).Before(stored.Expires) {
+			t.Error("[Server.handleStore] ttl not capped, expires ", stored.Expires)
+		}
+	}
+}
+
+func TestIdlePeer(t *testing.T) {
+	c := NewCluster(2, NewMemNetwork(0, 0, 1))
+	defer c.Close()
+	s := c.Servers[1]
+	p, err := s.connect(c.Servers[0].config.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ping(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	p.idmu.Lock()
+	p.used = time.Now().Add(-2 * peerOut)
+	p.idmu.Unlock()
+	s.keepalive(p)
+	select {
+	case <-p.quit:
+		t.Fatal("[Server.keepalive] idle peer of a node in the kbucket closed")
+	default:
+	}
+	s.config.Kbucket.RemoveNode(node.Node{ID: c.Servers[0].config.ID})
+	s.keepalive(p)
+	select {
+	case <-p.quit:
+	case <-time.After(time.Second):
+		t.Error("[Server.keepalive] idle peer out of the kbucket not closed")
+	}
+}
@@ -2,37 +2,61 @@ package server
 
 import (
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/kataras/golog"
 )
 
-type Transport struct {
+//Transport carries messages between servers
+type Transport interface {
+	//Dial get a peer which sends messages to addr
+	Dial(addr string, ot time.Duration) (*Peer, error)
+	//Accept listen on the server address and handle incoming messages until closed
+	Accept()
+	//Close stop listening
+	Close()
+}
+
+//TCPTransport a transport keeping one tcp connection per peer
+type TCPTransport struct {
 	server   *Server
 	listener *net.TCPListener
+	closed   int32
 }
 
-func NewTransport(s *Server) *Transport {
-	return &Transport{
+func NewTCPTransport(s *Server) *TCPTransport {
+	return &TCPTransport{
 		server: s,
 	}
 }
 
-func (t *Transport) Dial(addr string, ot time.Duration) (*Peer, error) {
-	destaddr, err := net.ResolveTCPAddr("tcp", addr)
+func (t *TCPTransport) Dial(addr string, ot time.Duration) (*Peer, error) {
+	conn, err := net.DialTimeout("tcp", addr, ot)
 	if err != nil {
 		return &Peer{}, err
 	}
-	conn, err := net.DialTCP("tcp", nil, destaddr)
+	if t.server.tlsconf == nil {
+		p := NewPeer(conn.RemoteAddr().String(), conn, 0)
+		p.setDialed()
+		p.setKeepalive(t.server.keepalive)
+		go t.server.handleConn(p, conn)
+		return p, nil
+	}
+	tconn, nid, err := dialSecure(conn, t.server.tlsconf, ot)
 	if err != nil {
+		conn.Close()
 		return &Peer{}, err
 	}
-	p := NewPeer(conn.RemoteAddr().String(), conn)
-	go t.handleConn(p)
+	p := NewPeer(conn.RemoteAddr().String(), tconn, 0)
+	p.setVerifiedID(nid)
+	p.setDialed()
+	p.setKeepalive(t.server.keepalive)
+	go t.server.handleConn(p, tconn)
 	return p, nil
 }
 
-func (t *Transport) Accept() {
+func (t *TCPTransport) Accept() {
 	hawServer, err := net.ResolveTCPAddr("tcp", t.server.config.Addr)
 	if err != nil {
 		golog.Fatal(err)
@@ -54,36 +78,35 @@ func (t *Transport) Accept() {
 			continue
 		}
 		conn.SetKeepAlive(true)
-		p := NewPeer(conn.RemoteAddr().String(), conn)
-		go t.handleConn(p)
+		go t.serve(conn)
 	}
 }
 
-func (t *Transport) handleConn(p *Peer) {
-	var err error
-	defer func() {
-		p.Disconnect(err)
-		t.server.unregister <- p
-	}()
-	t.server.register <- p
-	for {
-		msg := &Message{}
-		if err = msg.Decode(p.conn); err != nil {
-			golog.Error(err)
-			return
-		}
-		if err = t.server.handleMessage(p, msg); err != nil {
-			golog.Error(err)
-			return
-		}
+//serve secure an accepted connection if tls is on and handle it
+func (t *TCPTransport) serve(conn *net.TCPConn) {
+	if t.server.tlsconf == nil {
+		p := NewPeer(conn.RemoteAddr().String(), conn, 0)
+		t.server.handleConn(p, conn)
+		return
+	}
+	tconn, nid, err := acceptSecure(conn, t.server.tlsconf, outtime)
+	if err != nil {
+		golog.Warn("[transport.serve] handshake with ", conn.RemoteAddr().String(), " failed: ", err)
+		conn.Close()
+		return
 	}
+	p := NewPeer(conn.RemoteAddr().String(), tconn, 0)
+	p.setVerifiedID(nid)
+	t.server.handleConn(p, tconn)
 }
 
-func (t *Transport) isCloseError(err error) bool {
-	golog.Error(err)
-	return false
+func (t *TCPTransport) isCloseError(err error) bool {
+	return atomic.LoadInt32(&t.closed) == 1
 }
 
-func (t *Transport) Close() {
-	t.listener.Close()
+func (t *TCPTransport) Close() {
+	atomic.StoreInt32(&t.closed, 1)
+	if t.listener != nil {
+		t.listener.Close()
+	}
 }
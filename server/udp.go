@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+const (
+	//maxDatagram the largest encoded message sent in one datagram, larger
+	//messages go over the stream transport
+	maxDatagram = 1400
+	readBuffer  = 64 * 1024
+)
+
+//UDPTransport a transport sending every message as one datagram over a
+//single socket, peers are only addresses so there is no connection setup
+type UDPTransport struct {
+	server *Server
+	conn   *net.UDPConn
+	ready  chan struct{}
+	peers  map[string]*Peer
+	mu     sync.Mutex
+	closed int32
+}
+
+//udpConn writes datagrams to one remote address over the shared socket
+type udpConn struct {
+	t    *UDPTransport
+	key  string
+	addr *net.UDPAddr
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	return c.t.conn.WriteToUDP(b, c.addr)
+}
+
+//Close forget the peer, the socket is shared and closed with the transport
+func (c *udpConn) Close() error {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	if p, ok := c.t.peers[c.key]; ok && p.conn == c {
+		delete(c.t.peers, c.key)
+	}
+	return nil
+}
+
+func NewUDPTransport(s *Server) *UDPTransport {
+	return &UDPTransport{
+		server: s,
+		ready:  make(chan struct{}),
+		peers:  make(map[string]*Peer, 64),
+	}
+}
+
+func (t *UDPTransport) Dial(addr string, ot time.Duration) (*Peer, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return &Peer{}, err
+	}
+	select {
+	case <-t.ready:
+	case <-time.After(ot):
+		return &Peer{}, ErrTimeout
+	}
+	return t.peer(udpaddr), nil
+}
+
+func (t *UDPTransport) peer(addr *net.UDPAddr) *Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := addr.String()
+	if p, ok := t.peers[key]; ok {
+		return p
+	}
+	p := NewPeer(key, &udpConn{t: t, key: key, addr: addr}, maxDatagram)
+	p.setDialed()
+	p.setKeepalive(t.server.keepalive)
+	t.peers[key] = p
+	return p
+}
+
+func (t *UDPTransport) Accept() {
+	udpaddr, err := net.ResolveUDPAddr("udp", t.server.config.Addr)
+	if err != nil {
+		golog.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", udpaddr)
+	if err != nil {
+		golog.Fatal(err)
+	}
+	golog.Info("[udptransport.accept] listening on: ", udpaddr.String())
+	t.conn = conn
+	close(t.ready)
+
+	buf := make([]byte, readBuffer)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if atomic.LoadInt32(&t.closed) == 1 {
+				break
+			}
+			golog.Error("[udptransport][accept]", err)
+			continue
+		}
+		msg := &Message{}
+		r := bytes.NewReader(buf[:n])
+		err = msg.DecodeHeader(r, t.server.config.MaxFrameSize)
+		if err == nil {
+			err = msg.DecodeData(r)
+		}
+		if err != nil {
+			golog.Warn("[udptransport] bad datagram from ", from.String(), " ", err)
+			continue
+		}
+		p := t.peer(from)
+		go func() {
+			if err := t.server.handleMessage(p, msg); err != nil {
+				golog.Error("[udptransport] ", err)
+			}
+		}()
+	}
+}
+
+func (t *UDPTransport) Close() {
+	atomic.StoreInt32(&t.closed, 1)
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	t.mu.Lock()
+	peers := t.peers
+	t.peers = make(map[string]*Peer)
+	t.mu.Unlock()
+	for _, p := range peers {
+		p.close(nil)
+	}
+}
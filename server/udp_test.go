@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"kad/kbucket"
+	"kad/node"
+	"net"
+	"testing"
+	"time"
+)
+
+//startUDP start a server on the udp network of a free loopback port
+func startUDP(t *testing.T) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	id, _ := node.NewIdentity()
+	s := NewServer(Config{
+		Addr:      addr,
+		Identity:  id,
+		Kbucket:   kbucket.New(&node.Node{ID: id.ID, Addr: addr}),
+		Network:   "udp",
+		Plaintext: true,
+	})
+	go s.Start()
+	<-s.tran.(*UDPTransport).ready
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return s
+		}
+		if 50 < i {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPTransport(t *testing.T) {
+	a := startUDP(t)
+	defer a.Shutdown()
+	b := startUDP(t)
+	defer b.Shutdown()
+	ctx := context.Background()
+	p, err := b.connect(a.config.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.max != maxDatagram {
+		t.Fatal("[Server.connect] not a datagram peer")
+	}
+	nid, err := b.ping(ctx, p)
+	if err != nil || !nid.Equal(a.config.ID) {
+		t.Fatal("[Server.ping] ", err)
+	}
+	ns, err := b.FindNode(ctx, a.config.ID)
+	if err != nil || len(ns) == 0 || !ns[0].ID.Equal(a.config.ID) {
+		t.Fatal("[Server.FindNode] ", ns, " ", err)
+	}
+	value := bytes.Repeat([]byte("v"), 4*maxDatagram)
+	key := node.NewIDFromKey([]byte("large"))
+	buf := new(bytes.Buffer)
+	encodeID(buf, key)
+	binary.Write(buf, binary.LittleEndian, uint32(3600))
+	buf.Write(value)
+	if _, err := b.CallAddr(ctx, a.config.Addr, NewMessage(MAGIC, MSGStore, buf.Bytes())); err != nil {
+		t.Fatal("[Server.CallAddr] large message not sent over the stream: ", err)
+	}
+	if r, ok := a.store.Get(key); !ok || !bytes.Equal(r.Value, value) {
+		t.Fatal("[Server.CallAddr] large value not stored")
+	}
+	rep, err := b.query(ctx, node.Node{ID: a.config.ID, Addr: a.config.Addr}, key, MSGFindValue)
+	if err != nil || !bytes.Equal(rep.value, value) {
+		t.Error("[Server.query] large value not fetched over the stream: ", err)
+	}
+}
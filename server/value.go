@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"kad/node"
+	"kad/store"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+const (
+	recordTTL    = 24 * time.Hour
+	maxValueSize = 64 * 1024
+)
+
+//Put store value under key on the k closest nodes to the key, this node
+//republishes it until it is shut down
+func (s *Server) Put(key []byte, value []byte) error {
+	if maxValueSize < len(value) {
+		return errors.New("value too large")
+	}
+	r := store.Record{
+		Key:   node.NewIDFromKey(key),
+		Value: value,
+	}
+	s.publish(r)
+	return s.put(r)
+}
+
+//put store r on the k closest nodes to its key, it expires after RecordTTL
+func (s *Server) put(r store.Record) error {
+	ns, err := s.FindNode(context.Background(), r.Key)
+	if err != nil {
+		return err
+	}
+	r.Expires = time.Now().Add(s.config.RecordTTL)
+	stored, stale := 0, false
+	if s.isClosest(r.Key, ns) {
+		if err := s.keep(r); err != nil {
+			golog.Error("[server.put] ", err)
+			stale = stale || err == ErrSeqTooLow
+		} else {
+			stored++
+		}
+	}
+	for _, n := range ns {
+		if err := s.sendStore(context.Background(), n, r); err != nil {
+			golog.Warn("[server.put] store on ", n.Addr, " failed: ", err)
+			if re, ok := err.(*RemoteError); ok && re.Reason == ErrSeqTooLow.Error() {
+				stale = true
+			}
+			continue
+		}
+		stored++
+	}
+	if stale {
+		return ErrSeqTooLow
+	}
+	if stored == 0 {
+		return errors.New("no node to store the value")
+	}
+	return nil
+}
+
+//Get find the value stored under key in the network, for a mutable record
+//the one with the highest sequence number found by the lookup
+func (s *Server) Get(key []byte) ([]byte, error) {
+	r, err := s.get(node.NewIDFromKey(key), false)
+	if err != nil {
+		return nil, err
+	}
+	return r.Value, nil
+}
+
+//get look up the record of id, the mutable records are verified and the
+//highest sequence number is kept, otherwise the value found by a majority of
+//the lookup paths, only mutable records are accepted if mutable is set
+func (s *Server) get(id node.NodeID, mutable bool) (store.Record, error) {
+	var best *store.Record
+	if r, ok := s.store.Get(id); ok {
+		if !r.Mutable() && !mutable {
+			return r, nil
+		}
+		if r.Mutable() {
+			best = &r
+		}
+	}
+	votes := map[int][]byte{}
+	_, err := s.walk(context.Background(), id, MSGFindValue, func(rep reply) bool {
+		if !rep.found {
+			return false
+		}
+		if rep.record == nil {
+			if mutable || best != nil {
+				return false
+			}
+			if _, ok := votes[rep.path]; !ok {
+				votes[rep.path] = rep.value
+			}
+			return true
+		}
+		r := rep.record
+		if !r.Key.Equal(id) || !verifyMutable(*r) {
+			golog.Warn("[server.get] invalid mutable record for ", id.String())
+			return false
+		}
+		if best == nil || best.Seq < r.Seq {
+			best = r
+		}
+		return false
+	})
+	if best != nil {
+		return *best, nil
+	}
+	if v, ok := majority(votes, s.paths()); ok {
+		return store.Record{Key: id, Value: v}, nil
+	}
+	if err != nil {
+		return store.Record{}, err
+	}
+	if 0 < len(votes) {
+		return store.Record{}, errors.New("lookup paths disagree on the value")
+	}
+	return store.Record{}, errors.New("value not found")
+}
+
+//majority the value found by more than half of the paths
+func majority(votes map[int][]byte, paths int) ([]byte, bool) {
+	for _, v := range votes {
+		count := 0
+		for _, w := range votes {
+			if bytes.Equal(v, w) {
+				count++
+			}
+		}
+		if paths/2 < count {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+//isClosest check whether this node is among the k closest nodes to id
+func (s *Server) isClosest(id node.NodeID, closest []node.Node) bool {
+	if len(closest) < s.config.Kbucket.K() {
+		return true
+	}
+	self, err := node.CalDistance(s.config.ID, id)
+	if err != nil {
+		return false
+	}
+	last, err := node.CalDistance(closest[len(closest)-1].ID, id)
+	if err != nil {
+		return false
+	}
+	return self.Compare(last) < 0
+}
+
+func (s *Server) handleStore(p *Peer, m *Message) error {
+	r := bytes.NewReader(m.data)
+	id, err := decodeID(r)
+	if err != nil {
+		return err
+	}
+	var ttl uint32
+	if err := binary.Read(r, binary.LittleEndian, &ttl); err != nil {
+		return err
+	}
+	value, err := ioutil.ReadAll(io.LimitReader(r, maxValueSize+1))
+	if err != nil {
+		return err
+	}
+	if maxValueSize < len(value) {
+		return errors.New("value too large")
+	}
+	expires := s.scaledTTL(id, s.recordTTL(ttl))
+	golog.Debug("[server.handlestore] store ", id.String(), " from ", p.addr, " for ", expires)
+	err = s.keep(store.Record{
+		Key:     id,
+		Value:   value,
+		Expires: time.Now().Add(expires),
+	})
+	if err != nil {
+		return s.sendError(p, m, err.Error())
+	}
+	return s.reply(p, m, MSGStored, nil)
+}
+
+//recordTTL the lifetime of a record asked for sec seconds by a peer, at most
+//RecordTTL so no peer can pin a record in the network
+func (s *Server) recordTTL(sec uint32) time.Duration {
+	ttl := time.Duration(sec) * time.Second
+	if s.config.RecordTTL < ttl {
+		ttl = s.config.RecordTTL
+	}
+	return ttl
+}
+
+//keep store r locally, a mutable record is only replaced by one of its owner
+//with a higher sequence number, or the same one to refresh it
+func (s *Server) keep(r store.Record) error {
+	s.mmu.Lock()
+	defer s.mmu.Unlock()
+	cur, ok := s.store.Get(r.Key)
+	if ok && cur.Mutable() {
+		if !r.Mutable() {
+			return errors.New("key holds a mutable record")
+		}
+		if r.Seq < cur.Seq {
+			return ErrSeqTooLow
+		}
+		if r.Seq == cur.Seq && !bytes.Equal(r.Value, cur.Value) {
+			return errors.New("sequence number reused with another value")
+		}
+	}
+	return s.store.Put(r)
+}
+
+func (s *Server) handleFindValue(p *Peer, m *Message) error {
+	id, err := decodeID(bytes.NewReader(m.data))
+	if err != nil {
+		return err
+	}
+	if r, ok := s.store.Get(id); ok && (!r.Mutable() || p.Supports(CapMutable)) {
+		return s.sendValue(p, m, &r, nil)
+	}
+	ns, err := s.config.Kbucket.FindN(id, s.config.Kbucket.K())
+	if err != nil {
+		return err
+	}
+	return s.sendValue(p, m, nil, ns)
+}
+
+func decodeValue(data []byte) (reply, error) {
+	r := bytes.NewReader(data)
+	found, err := r.ReadByte()
+	if err != nil {
+		return reply{}, err
+	}
+	rep := reply{}
+	switch found {
+	case 3:
+		rec, err := decodeMutable(r)
+		if err != nil {
+			return reply{}, err
+		}
+		rep.found = true
+		rep.record = &rec
+		rep.value = rec.Value
+	case 2:
+		rep.stream = true
+	case 1:
+		rep.found = true
+		rep.value, err = ioutil.ReadAll(io.LimitReader(r, maxValueSize))
+	default:
+		rep.nodes, err = decodeNodes(r)
+	}
+	return rep, err
+}
+
+//sendStore store r on p and wait for the acknowledgement
+func (s *Server) sendStore(ctx context.Context, n node.Node, r store.Record) error {
+	buf := new(bytes.Buffer)
+	mtype := MSGStore
+	if r.Mutable() {
+		mtype = MSGStoreMutable
+	} else if err := encodeID(buf, r.Key); err != nil {
+		return err
+	}
+	ttl := uint32(time.Until(r.Expires) / time.Second)
+	if err := binary.Write(buf, binary.LittleEndian, &ttl); err != nil {
+		return err
+	}
+	if r.Mutable() {
+		if err := encodeMutable(buf, r); err != nil {
+			return err
+		}
+	} else {
+		buf.Write(r.Value)
+	}
+	_, err := s.CallNode(ctx, n, NewMessage(MAGIC, mtype, buf.Bytes()))
+	return err
+}
+
+//sendValue reply a FIND_VALUE with the record if it is found, otherwise with
+//the closest nodes, a value too large for the transport of p is only announced
+//so the requester asks again over the stream transport
+func (s *Server) sendValue(p *Peer, req *Message, r *store.Record, ns []node.Node) error {
+	buf := new(bytes.Buffer)
+	if r == nil {
+		buf.WriteByte(0)
+		if err := encodeNodes(buf, ns); err != nil {
+			return err
+		}
+		return s.reply(p, req, MSGValue, buf.Bytes())
+	}
+	if r.Mutable() {
+		buf.WriteByte(3)
+		if err := encodeMutable(buf, *r); err != nil {
+			return err
+		}
+	} else {
+		buf.WriteByte(1)
+		buf.Write(r.Value)
+	}
+	err := s.reply(p, req, MSGValue, buf.Bytes())
+	if err != ErrTooLarge {
+		return err
+	}
+	return s.reply(p, req, MSGValue, []byte{2})
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"kad/node"
+	"sync"
+	"time"
+)
+
+//MemStore an in-memory datastore
+type MemStore struct {
+	records map[node.NodeID]Record
+	mu      sync.RWMutex
+}
+
+//NewMemStore create an empty in-memory datastore
+func NewMemStore() *MemStore {
+	return &MemStore{
+		records: make(map[node.NodeID]Record, 64),
+	}
+}
+
+//Get get the record of key, an expired record is not found but is left for
+//Expire to remove, so a record put meanwhile is never deleted
+func (m *MemStore) Get(key node.NodeID) (Record, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r, ok := m.records[key]
+	if !ok || r.Expired(time.Now()) {
+		return Record{}, false
+	}
+	return r, true
+}
+
+//Put add or replace a record
+func (m *MemStore) Put(r Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records[r.Key] = r
+	return nil
+}
+
+//Delete remove the record of key
+func (m *MemStore) Delete(key node.NodeID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, key)
+	return nil
+}
+
+//Iterate call fn on every unexpired record until fn returns false
+func (m *MemStore) Iterate(fn func(r Record) bool) error {
+	now := time.Now()
+	m.mu.RLock()
+	rs := make([]Record, 0, len(m.records))
+	for _, r := range m.records {
+		if !r.Expired(now) {
+			rs = append(rs, r)
+		}
+	}
+	m.mu.RUnlock()
+	for _, r := range rs {
+		if !fn(r) {
+			break
+		}
+	}
+	return nil
+}
+
+//Expire remove the records expired at t
+func (m *MemStore) Expire(t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, r := range m.records {
+		if r.Expired(t) {
+			delete(m.records, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"kad/node"
+	"testing"
+	"time"
+)
+
+func TestMemStore(t *testing.T) {
+	m := NewMemStore()
+	key := node.NewIDFromKey([]byte("key"))
+	m.Put(Record{
+		Key:     key,
+		Value:   []byte("value"),
+		Expires: time.Now().Add(time.Hour),
+	})
+	r, ok := m.Get(key)
+	if !ok || string(r.Value) != "value" {
+		t.Error("[MemStore.Get] record not found")
+	}
+	m.Delete(key)
+	if _, ok := m.Get(key); ok {
+		t.Error("[MemStore.Delete] record not deleted")
+	}
+}
+
+func TestMemStoreExpire(t *testing.T) {
+	m := NewMemStore()
+	key0 := node.NewIDFromKey([]byte("key0"))
+	key1 := node.NewIDFromKey([]byte("key1"))
+	m.Put(Record{
+		Key:     key0,
+		Value:   []byte("value0"),
+		Expires: time.Now().Add(-time.Second),
+	})
+	m.Put(Record{
+		Key:     key1,
+		Value:   []byte("value1"),
+		Expires: time.Now().Add(time.Hour),
+	})
+	if _, ok := m.Get(key0); ok {
+		t.Error("[MemStore.Get] expired record returned")
+	}
+	count := 0
+	m.Iterate(func(r Record) bool {
+		count++
+		return true
+	})
+	if count != 1 {
+		t.Error("[MemStore.Iterate] count != 1")
+	}
+	m.Expire(time.Now().Add(2 * time.Hour))
+	if len(m.records) != 0 {
+		t.Error("[MemStore.Expire] ", len(m.records), " records left")
+	}
+}
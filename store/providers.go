@@ -0,0 +1,82 @@
+package store
+
+import (
+	"kad/node"
+	"sync"
+	"time"
+)
+
+//maxProviders how many providers are kept per key, the ones expiring first
+//make room for new ones
+const maxProviders = 64
+
+//MemProviders an in-memory provider store
+type MemProviders struct {
+	providers map[node.NodeID]map[node.NodeID]Provider
+	mu        sync.Mutex
+}
+
+//NewMemProviders create an empty in-memory provider store
+func NewMemProviders() *MemProviders {
+	return &MemProviders{
+		providers: make(map[node.NodeID]map[node.NodeID]Provider, 64),
+	}
+}
+
+//AddProvider add or refresh the record of p.Node for p.Key
+func (m *MemProviders) AddProvider(p Provider) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(p.Key, time.Now())
+	ps, ok := m.providers[p.Key]
+	if !ok {
+		ps = make(map[node.NodeID]Provider)
+		m.providers[p.Key] = ps
+	}
+	if _, ok := ps[p.Node.ID]; !ok && maxProviders <= len(ps) {
+		var first node.NodeID
+		for id, v := range ps {
+			if first.Equal(node.NodeID{}) || v.Expires.Before(ps[first].Expires) {
+				first = id
+			}
+		}
+		delete(ps, first)
+	}
+	ps[p.Node.ID] = p
+	return nil
+}
+
+//Providers the unexpired providers of key
+func (m *MemProviders) Providers(key node.NodeID) ([]Provider, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key, time.Now())
+	res := make([]Provider, 0, len(m.providers[key]))
+	for _, p := range m.providers[key] {
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+//Expire remove the provider records expired at t
+func (m *MemProviders) Expire(t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.providers {
+		m.expire(key, t)
+	}
+	return nil
+}
+
+//expire drop the expired providers of key
+func (m *MemProviders) expire(key node.NodeID, now time.Time) {
+	ps := m.providers[key]
+	for id, p := range ps {
+		if p.Expired(now) {
+			delete(ps, id)
+		}
+	}
+	if ps != nil && len(ps) == 0 {
+		delete(m.providers, key)
+	}
+}
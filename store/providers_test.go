@@ -0,0 +1,34 @@
+package store
+
+import (
+	"kad/node"
+	"testing"
+	"time"
+)
+
+func TestMemProviders(t *testing.T) {
+	m := NewMemProviders()
+	key := node.NewIDFromKey([]byte("content"))
+	alive := node.Node{ID: node.NewNodeID(), Addr: "addr0"}
+	gone := node.Node{ID: node.NewNodeID(), Addr: "addr1"}
+	m.AddProvider(Provider{Key: key, Node: alive, Expires: time.Now().Add(time.Hour)})
+	m.AddProvider(Provider{Key: key, Node: gone, Expires: time.Now().Add(-time.Second)})
+	m.AddProvider(Provider{Key: key, Node: alive, Expires: time.Now().Add(2 * time.Hour)})
+	ps, _ := m.Providers(key)
+	if len(ps) != 1 || !ps[0].Node.ID.Equal(alive.ID) {
+		t.Error("[MemProviders.Providers] ", len(ps), " providers, want the unexpired one once")
+	}
+	for i := 0; i < maxProviders+8; i++ {
+		n := node.Node{ID: node.NewNodeID(), Addr: "addr"}
+		m.AddProvider(Provider{Key: key, Node: n, Expires: time.Now().Add(3 * time.Hour)})
+	}
+	ps, _ = m.Providers(key)
+	if len(ps) != maxProviders {
+		t.Error("[MemProviders.AddProvider] ", len(ps), " providers kept, want ", maxProviders)
+	}
+	for _, p := range ps {
+		if p.Node.ID.Equal(alive.ID) {
+			t.Error("[MemProviders.AddProvider] the provider expiring first is kept")
+		}
+	}
+}
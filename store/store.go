@@ -0,0 +1,63 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"kad/node"
+	"time"
+)
+
+type (
+	//Record a value stored in the dht, a mutable record is keyed by the
+	//nodeid of its owner's public key and signed by the owner
+	Record struct {
+		Key       node.NodeID
+		Value     []byte
+		Expires   time.Time
+		PublicKey ed25519.PublicKey
+		Seq       uint64
+		Sig       []byte
+	}
+	//Datastore local storage of records
+	Datastore interface {
+		//Get get the record of key, expired records are never returned
+		Get(key node.NodeID) (Record, bool)
+		//Put add or replace a record
+		Put(r Record) error
+		//Delete remove the record of key
+		Delete(key node.NodeID) error
+		//Iterate call fn on every unexpired record until fn returns false
+		Iterate(fn func(r Record) bool) error
+		//Expire remove the records expired at t
+		Expire(t time.Time) error
+	}
+	//Provider a node announcing it has the content of a key
+	Provider struct {
+		Key     node.NodeID
+		Node    node.Node
+		Expires time.Time
+	}
+	//ProviderStore local storage of provider records, one per key and node
+	ProviderStore interface {
+		//AddProvider add or refresh the record of p.Node for p.Key
+		AddProvider(p Provider) error
+		//Providers the unexpired providers of key
+		Providers(key node.NodeID) ([]Provider, error)
+		//Expire remove the provider records expired at t
+		Expire(t time.Time) error
+	}
+)
+
+//Mutable check whether the record is signed by an owner
+func (r Record) Mutable() bool {
+	return r.PublicKey != nil
+}
+
+//Expired check whether the record is expired at t
+func (r Record) Expired(t time.Time) bool {
+	return !r.Expires.IsZero() && !t.Before(r.Expires)
+}
+
+//Expired check whether the provider record is expired at t
+func (p Provider) Expired(t time.Time) bool {
+	return !p.Expires.IsZero() && !t.Before(p.Expires)
+}